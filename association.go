@@ -0,0 +1,213 @@
+package mdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// Association many_to_many 中间表维护，同时同步 owner 上的关联字段
+type Association struct {
+	owner reflect.Value // owner 结构体，可寻址
+	rel   relation
+	exec  executor // Session.Model 时为事务，否则为 nil
+}
+
+// Association 获取 many_to_many 字段的关联操作，如 Model(stu).Association("Courses")
+func (sqlBuilder *SqlBuilder) Association(name string) *Association {
+	if len(sqlBuilder.Models) != 1 {
+		log.Panic("Association option has one table a time!")
+	}
+	var model interface{}
+	for model = range sqlBuilder.Models {}
+	owner := reflect.ValueOf(model).Elem()
+	rel, err := getRelation(owner.Type(), name)
+	if err != nil || rel.kind != ManyToMany {
+		log.Panicf("Association: %s.%s is not many_to_many!", owner.Type().Name(), name)
+	}
+	return &Association{owner: owner, rel: rel, exec: sqlBuilder.exec}
+}
+
+// Append 增加关联，已经存在的忽略
+func (association *Association) Append(targets ...interface{}) error {
+	ownerKey, relKeys, err := association.keys(targets)
+	if err != nil || len(relKeys) == 0 {
+		return err
+	}
+	err = association.inTx(func(tx executor) error {
+		return association.insertLinks(tx, ownerKey, relKeys)
+	})
+	if err != nil {
+		return err
+	}
+	field := association.owner.FieldByIndex(association.rel.field.Index)
+	field.Set(association.appendTargets(field, targets))
+	return nil
+}
+
+// Remove 删除关联，只删除中间表的记录
+func (association *Association) Remove(targets ...interface{}) error {
+	ownerKey, relKeys, err := association.keys(targets)
+	if err != nil || len(relKeys) == 0 {
+		return err
+	}
+	ownerColumn, relColumn := association.rel.joinColumns(association.owner.Type())
+	signs := make([]string, len(relKeys))
+	for i := range relKeys {
+		signs[i] = "?"
+	}
+	_sql := fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND %s IN (%s)",
+		association.rel.joinTable, ownerColumn, relColumn, strings.Join(signs, ","))
+	err = association.inTx(func(tx executor) error {
+		args := []interface{}{association.ownerArg(ownerKey)}
+		for _, relKey := range relKeys {
+			args = append(args, association.relArg(relKey))
+		}
+		log.Info(_sql, args)
+		_, err := tx.Exec(_sql, args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	removed := make(map[interface{}]bool)
+	for _, relKey := range relKeys {
+		removed[mapKey(relKey)] = true
+	}
+	field := association.owner.FieldByIndex(association.rel.field.Index)
+	kept := reflect.MakeSlice(field.Type(), 0, field.Len())
+	pk := primaryKeyField(association.rel.relType)
+	for i := 0; i < field.Len(); i++ {
+		item := field.Index(i)
+		if !removed[mapKey(pk.value(reflect.Indirect(item)))] {
+			kept = reflect.Append(kept, item)
+		}
+	}
+	field.Set(kept)
+	return nil
+}
+
+// Replace 替换全部关联，不传 targets 即清空
+func (association *Association) Replace(targets ...interface{}) error {
+	ownerKey, relKeys, err := association.keys(targets)
+	if err != nil {
+		return err
+	}
+	ownerColumn, _ := association.rel.joinColumns(association.owner.Type())
+	_sql := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", association.rel.joinTable, ownerColumn)
+	err = association.inTx(func(tx executor) error {
+		log.Info(_sql, ownerKey)
+		if _, err := tx.Exec(_sql, association.ownerArg(ownerKey)); err != nil {
+			return err
+		}
+		if len(relKeys) == 0 {
+			return nil
+		}
+		return association.insertLinks(tx, ownerKey, relKeys)
+	})
+	if err != nil {
+		return err
+	}
+	field := association.owner.FieldByIndex(association.rel.field.Index)
+	field.Set(association.appendTargets(reflect.MakeSlice(field.Type(), 0, len(targets)), targets))
+	return nil
+}
+
+func (association *Association) insertLinks(tx executor, ownerKey interface{}, relKeys []interface{}) error {
+	ownerColumn, relColumn := association.rel.joinColumns(association.owner.Type())
+	signs := make([]string, len(relKeys))
+	values := make([]interface{}, 0, len(relKeys)*2)
+	for i, relKey := range relKeys {
+		signs[i] = "(?,?)"
+		values = append(values, association.ownerArg(ownerKey), association.relArg(relKey))
+	}
+	_sql := fmt.Sprintf("INSERT IGNORE INTO %s(%s,%s) VALUES%s",
+		association.rel.joinTable, ownerColumn, relColumn, strings.Join(signs, ","))
+	log.Info(_sql, values)
+	_, err := tx.Exec(_sql, values...)
+	return err
+}
+
+// inTx 已经在 Write 的 Session 或者 XA 分支中的直接执行，否则开启一个事务
+func (association *Association) inTx(deal func(tx executor) error) error {
+	switch association.exec.(type) {
+	case *sqlx.Tx, xaConn:
+		return deal(association.exec)
+	}
+	return ObtainSession(Write, func(sess *Session) error {
+		return deal(sess.exec)
+	})
+}
+
+// ownerArg 主键值转换为 sql 参数，如 uuid 的主键
+func (association *Association) ownerArg(key interface{}) interface{} {
+	return primaryKeyField(association.owner.Type()).convert(key)
+}
+
+func (association *Association) relArg(key interface{}) interface{} {
+	return primaryKeyField(association.rel.relType).convert(key)
+}
+
+// keys 获取 owner 和 targets 的主键值，targets 为关联结构体或其指针
+func (association *Association) keys(targets []interface{}) (ownerKey interface{}, relKeys []interface{}, err error) {
+	ownerPk := primaryKeyField(association.owner.Type())
+	ownerKey = ownerPk.value(association.owner)
+	if ownerKey == nil {
+		return nil, nil, errors.New("mdb: association owner has no primary key value")
+	}
+	relPk := primaryKeyField(association.rel.relType)
+	for _, target := range targets {
+		v := targetValue(target)
+		if v.Type() != association.rel.relType {
+			log.Panicf("Association: %T is not %s!", target, association.rel.relType.Name())
+		}
+		relKey := relPk.value(v)
+		if relKey == nil {
+			return nil, nil, fmt.Errorf("mdb: association target %T has no primary key value", target)
+		}
+		relKeys = append(relKeys, relKey)
+	}
+	return
+}
+
+// targetValue target 为结构体时拷贝一份，取列的值需要可寻址
+func targetValue(target interface{}) reflect.Value {
+	v := reflect.Indirect(reflect.ValueOf(target))
+	if !v.CanAddr() {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr.Elem()
+	}
+	return v
+}
+
+// appendTargets 把 targets 追加到关联字段对应类型的 slice 上，已有的跳过
+func (association *Association) appendTargets(slice reflect.Value, targets []interface{}) reflect.Value {
+	isPtr := slice.Type().Elem().Kind() == reflect.Ptr
+	pk := primaryKeyField(association.rel.relType)
+	seen := make(map[interface{}]bool)
+	for i := 0; i < slice.Len(); i++ {
+		seen[mapKey(pk.value(reflect.Indirect(slice.Index(i))))] = true
+	}
+	for _, target := range targets {
+		key := mapKey(pk.value(targetValue(target)))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		v := reflect.ValueOf(target)
+		if isPtr && v.Kind() != reflect.Ptr {
+			ptr := reflect.New(association.rel.relType)
+			ptr.Elem().Set(v)
+			v = ptr
+		} else if !isPtr {
+			v = reflect.Indirect(v)
+		}
+		slice = reflect.Append(slice, v)
+	}
+	return slice
+}
@@ -0,0 +1,122 @@
+package mdb
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// collapser 合并 join 产生的重复行：每个表按主键去重，并且可以把子表的行嵌套到主表的关联字段上
+type collapser struct {
+	names  []string // Collapse 传入的关联字段
+	nests  []relation
+	pks    map[string]*fieldMeta              // 表名 -> 主键
+	seen   map[string]map[interface{}]int     // 表名 -> 主键 -> 在 dest 中的位置
+	nested map[string]map[[2]interface{}]bool // 关联字段 -> (主表主键, 子表主键)
+}
+
+// Collapse join 一对多时，按主键合并重复的行；nests 为主表上的关联字段，子表的行会嵌套进去
+// 如 Model(class, stu).Select(...).LeftJoin(stu, stu.ClassId.Eq(class.ID)).Collapse("Students").Map(&classes)
+// 嵌套的子表可以不传 dest
+func (sqlBuilder *SqlBuilder) Collapse(nests ...string) *SqlBuilder {
+	sqlBuilder.collapse = &collapser{names: nests}
+	return sqlBuilder
+}
+
+// prepareCollapse 主键需要在 select 中才能去重；嵌套的子表没有 dest 的补一个
+// dests 和 Map 一样需要是结构体数组的指针，否则返回 checkDest 的错误
+func (sqlBuilder *SqlBuilder) prepareCollapse(dests []interface{}) ([]interface{}, error) {
+	c := sqlBuilder.collapse
+	c.nests = nil
+	c.pks = make(map[string]*fieldMeta)
+	c.seen = make(map[string]map[interface{}]int)
+	c.nested = make(map[string]map[[2]interface{}]bool)
+	owner := sqlBuilder.mainModel().Type()
+	for _, name := range c.names {
+		rel, err := getRelation(owner, name)
+		if err != nil {
+			log.Panicf("Collapse: %v!", err)
+		}
+		c.nests = append(c.nests, rel)
+		c.nested[name] = make(map[[2]interface{}]bool)
+	}
+	err, destCatch := checkDest(nil, dests...)
+	if err != nil {
+		return nil, err
+	}
+	destTables := make(map[string]bool)
+	for table := range destCatch {
+		destTables[table] = true
+	}
+	for _, rel := range c.nests {
+		if !destTables[tableName(rel.relType)] {
+			destTables[tableName(rel.relType)] = true
+			dests = append(dests, reflect.New(reflect.SliceOf(rel.relType)).Interface())
+		}
+	}
+	for model, table := range sqlBuilder.Models {
+		if !destTables[table] {
+			continue
+		}
+		refValue := reflect.ValueOf(model).Elem()
+		pk := primaryKeyField(refValue.Type())
+		c.pks[table] = pk
+		c.seen[table] = make(map[interface{}]int)
+		opt := pk.opt(refValue)
+		if sqlBuilder.selectIndex(*opt) == -1 {
+			sqlBuilder.SelectFields = append(sqlBuilder.SelectFields, selectField{tableName: opt.tableName,
+				columnName: opt.dbColumnName, orgColumnName: opt.orgColumnName})
+		}
+	}
+	return dests, nil
+}
+
+// add 处理一行：每个表主键第一次出现才追加到 dest；left join 没有匹配（主键为 null）的跳过
+func (c *collapser) add(mainTable string, destCatch map[string]destCell, instMap map[string]reflect.Value) {
+	keys := make(map[string]interface{})
+	for table, obj := range instMap {
+		if c.pks[table] == nil {
+			continue
+		}
+		pk := mapKey(c.pks[table].value(obj)) // binary 的主键转换为 string 才能作为 map key
+		if pk == nil {
+			continue
+		}
+		keys[table] = pk
+		if _, ok := c.seen[table][pk]; ok {
+			continue
+		}
+		slice := destCatch[table].slice
+		c.seen[table][pk] = slice.Len()
+		slice.Set(reflect.Append(slice, obj))
+	}
+	parentKey, ok := keys[mainTable]
+	if !ok || len(c.nests) == 0 {
+		return
+	}
+	parent := reflect.Indirect(destCatch[mainTable].slice.Index(c.seen[mainTable][parentKey]))
+	for _, rel := range c.nests {
+		childTable := tableName(rel.relType)
+		childKey, ok := keys[childTable]
+		if !ok || c.nested[rel.field.Name][[2]interface{}{parentKey, childKey}] {
+			continue
+		}
+		c.nested[rel.field.Name][[2]interface{}{parentKey, childKey}] = true
+		child := instMap[childTable]
+		field := parent.FieldByIndex(rel.field.Index)
+		switch {
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Ptr:
+			ptr := reflect.New(rel.relType)
+			ptr.Elem().Set(child)
+			field.Set(reflect.Append(field, ptr))
+		case field.Kind() == reflect.Slice:
+			field.Set(reflect.Append(field, child))
+		case field.Kind() == reflect.Ptr:
+			ptr := reflect.New(rel.relType)
+			ptr.Elem().Set(child)
+			field.Set(ptr)
+		default:
+			field.Set(child)
+		}
+	}
+}
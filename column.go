@@ -0,0 +1,228 @@
+package mdb
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"reflect"
+)
+
+// ColumnKind 描述一个列类型：数据库中的类型名，以及 driver 返回值到 T 的转换
+type ColumnKind[T any] interface {
+	SqlType() string
+	Convert(src interface{}) (T, error)
+}
+
+// kindValuer ColumnKind 可选实现，T 不能直接交给 driver 时（比如 json）自定义转换
+type kindValuer[T any] interface {
+	Value(v T) (driver.Value, error)
+}
+
+// kindFormatter ColumnKind 可选实现，T 默认的 json 文本形式不合适时（比如 time 的 time.Duration）自定义
+type kindFormatter[T any] interface {
+	Format(v T) string
+}
+
+// kindArg ColumnKind 可选实现，Term 中和该列比较的值需要转换时（比如 uuid 的字符串转为 16 个字节）
+type kindArg interface {
+	Arg(v interface{}) interface{}
+}
+
+// State 列的三种状态，决定 insert update upsert 如何处理该列
+type State int8
+
+const (
+	StateUnset State = iota // 没有赋值：零值并且没有 NotNul，insert update 忽略
+	StateNull               // 显式 null：Null[Int]() SetNull() 或者 scan 到 null，写入 NULL
+	StateValue              // 有值：非零值或者 NotNul，写入 V
+)
+
+// Column 所有列类型都实现的接口，builder scanner migrator 通过它处理列，不再判断具体类型
+type Column interface {
+	sql.Scanner
+	driver.Valuer
+	SqlType() string
+	State() State
+	IsNull() bool
+	SetNull()
+	option() Opt
+	value() interface{}
+}
+
+// Col 泛型列，Varchar 等具体类型见 types.go
+type Col[T any, K ColumnKind[T]] struct {
+	V      T
+	NotNul bool
+	Raw    interface{} // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
+	null   bool        // 显式 null，见 State
+	Opt
+}
+
+func (col Col[T, K]) SqlType() string {
+	var kind K
+	return kind.SqlType()
+}
+
+// State 有值优先：赋值了 V 或者 NotNul 即为有值，即使之前 scan 到的是 null
+func (col Col[T, K]) State() State {
+	if col.NotNul || !reflect.ValueOf(&col.V).Elem().IsZero() {
+		return StateValue
+	}
+	if col.null {
+		return StateNull
+	}
+	return StateUnset
+}
+
+func (col Col[T, K]) IsNull() bool {
+	return col.State() == StateNull
+}
+
+// argKind kind 实现了 kindArg 返回 kind，否则为 nil
+func (col Col[T, K]) argKind() kindArg {
+	var kind K
+	arg, _ := interface{}(kind).(kindArg)
+	return arg
+}
+
+// Set 赋值，零值也会写入数据库
+func (col *Col[T, K]) Set(v T) {
+	col.V = v
+	col.NotNul = true
+	col.null = false
+}
+
+// SetNull 显式设置为 null，insert update 写入 NULL
+func (col *Col[T, K]) SetNull() {
+	var zero T
+	col.V = zero
+	col.NotNul = false
+	col.null = true
+}
+
+// value 列的值，unset 和 null 都返回 nil
+func (col Col[T, K]) value() interface{} {
+	if col.State() != StateValue {
+		return nil
+	}
+	return col.V
+}
+
+// Value 实现 driver.Valuer，可以直接作为 database/sql 的参数；unset 和 null 返回 nil
+func (col Col[T, K]) Value() (driver.Value, error) {
+	if col.State() != StateValue {
+		return nil, nil
+	}
+	var kind K
+	if valuer, ok := interface{}(kind).(kindValuer[T]); ok {
+		return valuer.Value(col.V)
+	}
+	return driver.DefaultParameterConverter.ConvertValue(col.V)
+}
+
+// Scan 实现 sql.Scanner，src 可以是 driver 返回的任意类型，无法转换的返回错误
+func (col *Col[T, K]) Scan(src interface{}) error {
+	if src == nil {
+		col.SetNull()
+		col.Raw = nil
+		return nil
+	}
+	var kind K
+	v, err := kind.Convert(src)
+	if err != nil {
+		return err
+	}
+	col.Set(v)
+	col.Raw = v
+	return nil
+}
+
+// MarshalJSON 输出裸值，unset 和 null 输出 null
+func (col Col[T, K]) MarshalJSON() ([]byte, error) {
+	if col.State() != StateValue {
+		return []byte("null"), nil
+	}
+	var kind K
+	if formatter, ok := interface{}(kind).(kindFormatter[T]); ok {
+		return json.Marshal(formatter.Format(col.V))
+	}
+	return json.Marshal(col.V)
+}
+
+// UnmarshalJSON null 为显式 null；T 解析不了的（如 "12" 之于 Int，"2006-01-02 15:04:05" 之于 Datetime）按 Scan 的规则转换
+func (col *Col[T, K]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		col.SetNull()
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err == nil {
+		col.Set(v)
+		return nil
+	}
+	var src interface{} = data
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		src = s
+	}
+	var kind K
+	v, err := kind.Convert(src)
+	if err != nil {
+		return err
+	}
+	col.Set(v)
+	return nil
+}
+
+// MarshalText 实现 encoding.TextMarshaler，用于 query 参数 yaml 等；unset 和 null 输出空
+func (col Col[T, K]) MarshalText() ([]byte, error) {
+	if col.State() != StateValue {
+		return []byte{}, nil
+	}
+	var kind K
+	if formatter, ok := interface{}(kind).(kindFormatter[T]); ok {
+		return []byte(formatter.Format(col.V)), nil
+	}
+	if marshaler, ok := interface{}(col.V).(encoding.TextMarshaler); ok {
+		return marshaler.MarshalText()
+	}
+	if valuer, ok := interface{}(kind).(kindValuer[T]); ok {
+		v, err := valuer.Value(col.V)
+		if err != nil {
+			return nil, err
+		}
+		return asText(v)
+	}
+	return asText(col.V)
+}
+
+// UnmarshalText 空文本为显式 null，其余按 Scan 的规则转换
+func (col *Col[T, K]) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		col.SetNull()
+		return nil
+	}
+	var kind K
+	v, err := kind.Convert(string(text))
+	if err != nil {
+		return err
+	}
+	col.Set(v)
+	return nil
+}
+
+// Null 返回显式 null 的列，如 mdb.Null[mdb.Int]()
+func Null[C any, PC interface {
+	*C
+	SetNull()
+}]() C {
+	var col C
+	PC(&col).SetNull()
+	return col
+}
@@ -0,0 +1,283 @@
+package mdb
+
+import (
+	"database/sql/driver"
+	"encoding"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// driver 返回的值可能是 []byte string int64 float64 bool time.Time
+// 和 interpolateParams parseTime 等参数有关，这里统一转换，转换不了的返回错误而不是零值
+
+// timeLayouts 解析 date datetime 使用，和 mysql 的返回格式一致
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02",
+}
+
+func errConvert(src interface{}, target string) error {
+	return fmt.Errorf("mdb: can not convert %T(%v) to %s", src, src, target)
+}
+
+func asString(src interface{}) (string, error) {
+	switch v := src.(type) {
+	case []byte:
+		return string(v), nil
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		return v.Format(timeLayouts[0]), nil
+	}
+	return "", errConvert(src, "string")
+}
+
+func asBytes(src interface{}) ([]byte, error) {
+	switch v := src.(type) {
+	case []byte:
+		// driver 的 []byte 在下一次 Next 时会被复用，这里需要拷贝
+		return append([]byte(nil), v...), nil
+	case string:
+		return []byte(v), nil
+	}
+	s, err := asString(src)
+	if err != nil {
+		return nil, errConvert(src, "[]byte")
+	}
+	return []byte(s), nil
+}
+
+func asInt(src interface{}, bitSize int) (int64, error) {
+	target := fmt.Sprintf("int%d", bitSize)
+	var n int64
+	switch v := src.(type) {
+	case int64:
+		n = v
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, errConvert(src, target)
+		}
+		n = int64(v)
+	case bool:
+		if v {
+			n = 1
+		}
+	case []byte, string:
+		s, _ := asString(v)
+		parsed, err := strconv.ParseInt(strings.TrimSpace(s), 10, bitSize)
+		if err != nil {
+			return 0, errConvert(src, target)
+		}
+		return parsed, nil
+	default:
+		return 0, errConvert(src, target)
+	}
+	if bitSize < 64 && (n < -1<<(bitSize-1) || n > 1<<(bitSize-1)-1) {
+		return 0, errConvert(src, target)
+	}
+	return n, nil
+}
+
+// asUint unsigned 列，bigint unsigned 超过 int64 的值 driver 返回 uint64；负数返回错误
+func asUint(src interface{}, bitSize int) (uint64, error) {
+	target := fmt.Sprintf("uint%d", bitSize)
+	var n uint64
+	switch v := src.(type) {
+	case uint64:
+		n = v
+	case int64:
+		if v < 0 {
+			return 0, errConvert(src, target)
+		}
+		n = uint64(v)
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v >= math.MaxUint64 {
+			return 0, errConvert(src, target)
+		}
+		n = uint64(v)
+	case bool:
+		if v {
+			n = 1
+		}
+	case []byte, string:
+		s, _ := asString(v)
+		parsed, err := strconv.ParseUint(strings.TrimSpace(s), 10, bitSize)
+		if err != nil {
+			return 0, errConvert(src, target)
+		}
+		return parsed, nil
+	default:
+		return 0, errConvert(src, target)
+	}
+	if bitSize < 64 && n > 1<<bitSize-1 {
+		return 0, errConvert(src, target)
+	}
+	return n, nil
+}
+
+func asFloat(src interface{}, bitSize int) (float64, error) {
+	target := fmt.Sprintf("float%d", bitSize)
+	var f float64
+	switch v := src.(type) {
+	case float64:
+		f = v
+	case int64:
+		f = float64(v)
+	case []byte, string:
+		s, _ := asString(v)
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(s), bitSize)
+		if err != nil {
+			return 0, errConvert(src, target)
+		}
+		return parsed, nil
+	default:
+		return 0, errConvert(src, target)
+	}
+	if bitSize == 32 && math.Abs(f) > math.MaxFloat32 && !math.IsInf(f, 0) {
+		return 0, errConvert(src, target)
+	}
+	return f, nil
+}
+
+func asDecimal(src interface{}) (decimal.Decimal, error) {
+	switch v := src.(type) {
+	case int64:
+		return decimal.NewFromInt(v), nil
+	case float64:
+		return decimal.NewFromFloat(v), nil
+	case []byte, string:
+		s, _ := asString(v)
+		d, err := decimal.NewFromString(strings.TrimSpace(s))
+		if err != nil {
+			return decimal.Zero, errConvert(src, "decimal")
+		}
+		return d, nil
+	}
+	return decimal.Zero, errConvert(src, "decimal")
+}
+
+// asTime parseTime 关闭时 driver 返回 []byte，使用 UTC 和 driver 的默认 loc 一致
+func asTime(src interface{}) (time.Time, error) {
+	switch v := src.(type) {
+	case time.Time:
+		return v, nil
+	case []byte, string:
+		s, _ := asString(v)
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "0000-00-00") {
+			return time.Time{}, nil
+		}
+		for _, layout := range timeLayouts {
+			if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, errConvert(src, "time.Time")
+}
+
+// asDuration mysql time 的范围是 -838:59:59 到 838:59:59，可以带小数秒，不能用 time.Time 表示
+func asDuration(src interface{}) (time.Duration, error) {
+	switch v := src.(type) {
+	case time.Duration:
+		return v, nil
+	case []byte, string:
+		s, _ := asString(v)
+		s = strings.TrimSpace(s)
+		var neg bool
+		if strings.HasPrefix(s, "-") {
+			neg, s = true, s[1:]
+		}
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 {
+			break
+		}
+		hours, err1 := strconv.ParseUint(parts[0], 10, 16)
+		minutes, err2 := strconv.ParseUint(parts[1], 10, 8)
+		seconds, err3 := strconv.ParseFloat(parts[2], 64)
+		if err1 != nil || err2 != nil || err3 != nil || minutes > 59 || seconds >= 60 {
+			break
+		}
+		d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+			time.Duration(math.Round(seconds*1e6))*time.Microsecond
+		if neg {
+			d = -d
+		}
+		return d, nil
+	}
+	return 0, errConvert(src, "time.Duration")
+}
+
+// formatDuration 转换为 mysql time 的格式，如 -12:30:00.5
+func formatDuration(d time.Duration) string {
+	var sign string
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	d = d.Round(time.Microsecond)
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+	if frac := d % time.Second; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%06d", frac/time.Microsecond), "0")
+	}
+	return s
+}
+
+func asBool(src interface{}) (bool, error) {
+	switch v := src.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case []byte, string:
+		s, _ := asString(v)
+		s = strings.TrimSpace(s)
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n != 0, nil
+		}
+	}
+	return false, errConvert(src, "bool")
+}
+
+// asText 列值的文本形式，可以被对应的 Convert 解析回来
+func asText(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return append([]byte(nil), v...), nil
+	case bool:
+		return []byte(strconv.FormatBool(v)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float32:
+		return []byte(strconv.FormatFloat(float64(v), 'f', -1, 32)), nil
+	case time.Time:
+		return []byte(v.Format(time.RFC3339Nano)), nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+	dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+	if err != nil {
+		return nil, err
+	}
+	s, err := asString(dv)
+	return []byte(s), err
+}
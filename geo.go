@@ -0,0 +1,125 @@
+package mdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SRID point 列使用 WGS 84，和 gps 的经纬度一致
+const SRID = 4326
+
+// GeoPoint 经纬度，Point 列的值
+type GeoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// MarshalJSON 输出 {"lat":..,"lng":..}
+func (p GeoPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{"lat": p.Lat, "lng": p.Lng})
+}
+
+func (p *GeoPoint) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Lat *float64 `json:"lat"`
+		Lng *float64 `json:"lng"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Lat == nil || v.Lng == nil {
+		return fmt.Errorf("mdb: point %s need lat and lng", data)
+	}
+	p.Lat, p.Lng = *v.Lat, *v.Lng
+	return nil
+}
+
+// MarshalText 文本形式为 lat,lng，用于 query 参数等
+func (p GeoPoint) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatFloat(p.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lng, 'f', -1, 64)), nil
+}
+
+func (p *GeoPoint) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("mdb: point %q should be lat,lng", text)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("mdb: point %q should be lat,lng", text)
+	}
+	p.Lat, p.Lng = lat, lng
+	return nil
+}
+
+// asPoint driver 返回的是 mysql 内部格式：4 个字节的 SRID + WKB，也接受不带 SRID 的 WKB
+// 内部格式中地理坐标总是 x 为经度，y 为纬度，和 SRID 定义的轴顺序无关
+func asPoint(src interface{}) (GeoPoint, error) {
+	switch v := src.(type) {
+	case []byte:
+		wkb := v
+		if len(wkb) == 25 {
+			wkb = wkb[4:]
+		}
+		if len(wkb) != 21 || wkb[0] > 1 {
+			break
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if wkb[0] == 1 {
+			order = binary.LittleEndian
+		}
+		if order.Uint32(wkb[1:5]) != 1 { // 1 为 point
+			break
+		}
+		return GeoPoint{
+			Lng: math.Float64frombits(order.Uint64(wkb[5:13])),
+			Lat: math.Float64frombits(order.Uint64(wkb[13:21])),
+		}, nil
+	case string:
+		var p GeoPoint
+		if err := p.UnmarshalText([]byte(v)); err != nil {
+			break
+		}
+		return p, nil
+	}
+	return GeoPoint{}, errConvert(src, "point")
+}
+
+// pointValue 转换为 mysql 内部格式，可以直接写入 point 列
+func pointValue(p GeoPoint) []byte {
+	b := make([]byte, 25)
+	binary.LittleEndian.PutUint32(b[0:4], SRID)
+	b[4] = 1
+	binary.LittleEndian.PutUint32(b[5:9], 1)
+	binary.LittleEndian.PutUint64(b[9:17], math.Float64bits(p.Lng))
+	binary.LittleEndian.PutUint64(b[17:25], math.Float64bits(p.Lat))
+	return b
+}
+
+// distanceExpr 列到 (lat, lng) 的球面距离，单位米；POINT(x, y) 的 x 为经度
+func distanceExpr(o Opt) string {
+	return fmt.Sprintf("ST_Distance_Sphere(%s, ST_SRID(POINT(?, ?), %d))", o.column(), SRID)
+}
+
+// WithinDistance point 列到 (lat, lng) 的距离不超过 meters 米
+func (o Opt) WithinDistance(lat, lng, meters float64) Term {
+	return Term{Op: OpExpr, One: distanceExpr(o) + " <= ?", Args: []interface{}{lng, lat, meters}}
+}
+
+// OrderByDistance 按 point 列到 (lat, lng) 的距离由近到远排序，可以和 OrderBy 一起使用
+func (sqlBuilder *SqlBuilder) OrderByDistance(point interface{}, lat, lng float64) *SqlBuilder {
+	opt := getOpt(point)
+	if opt == nil {
+		log.Panicf("OrderByDistance: %T is not a model field!", point)
+	}
+	sqlBuilder.orderBys = append(sqlBuilder.orderBys, Order{opt: *opt, expr: distanceExpr(*opt),
+		args: []interface{}{lng, lat}})
+	return sqlBuilder
+}
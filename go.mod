@@ -1,6 +1,6 @@
 module gomdb
 
-go 1.17
+go 1.18
 
 require (
 	github.com/deckarep/golang-set v1.8.0
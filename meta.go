@@ -0,0 +1,177 @@
+package mdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelMetas 结构体类型 -> *modelMeta，每个 model 类型只解析一次，并发安全
+var modelMetas sync.Map
+
+var optType = reflect.TypeOf(Opt{})
+var columnType = reflect.TypeOf((*Column)(nil)).Elem()
+var uuidValueType = reflect.TypeOf(UUIDValue{})
+var timeType = reflect.TypeOf(time.Time{})
+
+// modelMeta model 结构体的元信息，builder scanner migrator 共用
+type modelMeta struct {
+	tableName  string
+	fields     []*fieldMeta // 表的列，不包含关联字段，顺序同结构体
+	byName     map[string]*fieldMeta
+	byColumn   map[string]*fieldMeta
+	primaryKey *fieldMeta // 没有声明 primary key 的使用 ID，都没有为 nil
+	relations  map[string]relation
+}
+
+// fieldMeta 一个列的元信息
+type fieldMeta struct {
+	name     string // 结构体字段名
+	column   string // 数据库列名
+	index    []int
+	typ      reflect.Type
+	tag      string // mdb tag，小写
+	sqlType  string // 数据库类型名，如 varchar
+	exported bool
+	optIndex []int    // 列类型中内嵌 Opt 的位置，不是 mdb 列类型为 nil
+	values   []string // enum set 允许的值，来自 tag，保留大小写
+	arg      kindArg  // Term 参数的转换，见 kindArg
+}
+
+// getModelMeta 获取 t（结构体或其指针）的元信息
+func getModelMeta(t reflect.Type) *modelMeta {
+	t = Deref(t)
+	if meta, ok := modelMetas.Load(t); ok {
+		return meta.(*modelMeta)
+	}
+	meta, _ := modelMetas.LoadOrStore(t, parseModelMeta(t))
+	return meta.(*modelMeta)
+}
+
+func parseModelMeta(t reflect.Type) *modelMeta {
+	if t.Kind() != reflect.Struct {
+		log.Panicf("model %s must be a struct!", t.String())
+	}
+	_array := strings.Split(t.String(), ".")
+	meta := &modelMeta{
+		tableName: UnMarshal4Camel(_array[len(_array)-1]),
+		byName:    make(map[string]*fieldMeta),
+		byColumn:  make(map[string]*fieldMeta),
+		relations: make(map[string]relation),
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if rel, ok := parseRelation(f); ok {
+			meta.relations[f.Name] = rel
+			continue
+		}
+		field := &fieldMeta{
+			name:     f.Name,
+			column:   UnMarshal4Camel(f.Name),
+			index:    f.Index,
+			typ:      f.Type,
+			tag:      strings.ToLower(f.Tag.Get("mdb")),
+			exported: f.PkgPath == "",
+		}
+		if reflect.PtrTo(f.Type).Implements(columnType) {
+			column := reflect.New(f.Type).Interface().(Column)
+			field.sqlType = column.SqlType()
+			if holder, ok := column.(interface{ argKind() kindArg }); ok {
+				field.arg = holder.argKind()
+			}
+			// Opt 可能在更深一层，如 JSON[T] 内嵌 Col
+			if sub, ok := f.Type.FieldByName("Opt"); ok && sub.Anonymous && sub.Type == optType {
+				field.optIndex = sub.Index
+			}
+		} else {
+			_array := strings.Split(f.Type.String(), ".")
+			field.sqlType = strings.ToLower(_array[len(_array)-1])
+		}
+		if valuesTypes[field.sqlType] {
+			if v, ok := tagValue(f.Tag.Get("mdb"), field.sqlType); ok {
+				field.values = strings.Split(v, ",")
+			}
+		}
+		meta.fields = append(meta.fields, field)
+		meta.byName[field.name] = field
+		meta.byColumn[field.column] = field
+		if meta.primaryKey == nil && strings.Index(field.tag, "primary key") != -1 {
+			meta.primaryKey = field
+		}
+	}
+	if meta.primaryKey == nil {
+		meta.primaryKey = meta.byName["ID"]
+	}
+	return meta
+}
+
+// tagValue 原始 tag 中 key:value 的 value，key 不区分大小写，value 保留大小写
+func tagValue(tag, key string) (string, bool) {
+	for _, item := range strings.Split(tag, " ") {
+		if len(item) > len(key) && strings.EqualFold(item[:len(key)+1], key+":") {
+			return item[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// validate 检查 enum set 写入的值是否在 tag 声明的范围内，value 为 driver.Value
+func (field *fieldMeta) validate(value interface{}) error {
+	s, ok := value.(string)
+	if len(field.values) == 0 || !ok {
+		return nil
+	}
+	items := []string{s}
+	if field.sqlType == "set" {
+		items = strings.Split(s, ",")
+		if s == "" {
+			items = nil
+		}
+	}
+	for _, item := range items {
+		var found bool
+		for _, allowed := range field.values {
+			if item == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("mdb: %s value %q of column %s is not in (%s)",
+				field.sqlType, item, field.column, strings.Join(field.values, ","))
+		}
+	}
+	return nil
+}
+
+// isColumn 是否是 mdb 的列类型（内嵌 Opt）
+func (field *fieldMeta) isColumn() bool {
+	return field.exported && field.optIndex != nil
+}
+
+// opt 获取结构体上该列的 Opt 地址，model 需要可寻址
+func (field *fieldMeta) opt(model reflect.Value) *Opt {
+	return model.FieldByIndex(field.index).FieldByIndex(field.optIndex).Addr().Interface().(*Opt)
+}
+
+// value 列的值，unset 和 null 返回 nil
+func (field *fieldMeta) value(model reflect.Value) interface{} {
+	return columnRawValue(model.FieldByIndex(field.index).Addr().Interface())
+}
+
+// convert 转换为 sql 参数，如 uuid 的主键值
+func (field *fieldMeta) convert(v interface{}) interface{} {
+	if field.arg == nil {
+		return v
+	}
+	return field.arg.Arg(v)
+}
+
+// columnOf 获取结构体上该列，model 需要可寻址
+func (field *fieldMeta) columnOf(model reflect.Value) Column {
+	return model.FieldByIndex(field.index).Addr().Interface().(Column)
+}
@@ -19,8 +19,16 @@ func ForceSync(charset string, localModels ...interface{}) error {
 	// 将本地和远程翻译成 TableStruct
 	var locals []TableStruct
 	var remotes []TableStruct
+	joinTables := make(map[string]bool)
 	for _, model := range localModels {
 		locals = append(locals, Model2Struct(model))
+		// many_to_many 的中间表，两边都声明的只创建一次
+		for _, joinTable := range JoinTableStructs(model) {
+			if !joinTables[joinTable.TableName] {
+				joinTables[joinTable.TableName] = true
+				locals = append(locals, joinTable)
+			}
+		}
 	}
 	err, tables := getAllTables2Sql()
 	if err != nil {
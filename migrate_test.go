@@ -1,14 +1,144 @@
 package mdb
 
 import (
+	"strings"
 	"testing"
 )
 
+type typesModel struct {
+	ID       Bigint    `mdb:"primary key"`
+	Code     Char      `mdb:"length:2 not null"`
+	Digest   Binary    `mdb:"length:16"`
+	Token    Varbinary `mdb:"length:64"`
+	Body     MediumText
+	Content  LongText
+	Image    MediumBlob
+	Archive  LongBlob
+	Amount   Mediumint
+	Born     Year
+	Birthday Date
+	Start    Time
+	Updated  Timestamp
+	Visits   Uint64 `mdb:"not null default 0"`
+	Level    Uint8
+	Status   Enum `mdb:"enum:Active,in_progress,it's not null"`
+	Roles    Set  `mdb:"set:read,write"`
+	Location Point `mdb:"spatial index"`
+	Center   Point
+}
+
 func TestForceSync(t *testing.T)  {
-	err := ForceSync("utf8", &School{}, &Class{}, &Student{})
+	err := ForceSync("utf8", &School{}, &Class{}, &Student{}, &Course{}, &Profile{}, &Store{}, &Device{}, &Comment{}, &Outbox{})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 
+func TestSql2StructTypes(t *testing.T)  {
+	local := Model2Struct(&typesModel{})
+	expect := map[string]string{
+		"id": "bigint", "code": "char(2)", "digest": "binary(16)", "token": "varbinary(64)",
+		"body": "mediumtext", "content": "longtext", "image": "mediumblob", "archive": "longblob",
+		"amount": "mediumint", "born": "year", "birthday": "date", "start": "time", "updated": "timestamp",
+		"visits": "bigint unsigned", "level": "tinyint unsigned",
+		"status": "enum('Active','in_progress','it''s')", "roles": "set('read','write')",
+		"location": "point", "center": "point",
+	}
+	if profile := Model2Struct(&Profile{}); profile.ColumnTypes["settings"] != "json" {
+		t.Errorf("settings: expect json, got %s", profile.ColumnTypes["settings"])
+	}
+	for column, columnType := range expect {
+		if local.ColumnTypes[column] != columnType {
+			t.Errorf("%s: expect %s, got %s", column, columnType, local.ColumnTypes[column])
+		}
+	}
+	if local.Constraints["body"] != "" || local.Constraints["born"] != "default null" ||
+		local.Constraints["status"] != "not null" || local.Constraints["roles"] != "default null" ||
+		local.Constraints["location"] != "srid 4326 not null" || local.Constraints["center"] != "srid 4326" {
+		t.Errorf("got constraints %v", local.Constraints)
+	}
+	// show create table 返回的格式
+	remote := Sql2Struct("CREATE TABLE `types_model` (\n" +
+		"  `id` bigint(20) NOT NULL,\n" +
+		"  `code` char(2) NOT NULL,\n" +
+		"  `digest` binary(16) DEFAULT NULL,\n" +
+		"  `token` varbinary(64) DEFAULT NULL,\n" +
+		"  `body` mediumtext,\n" +
+		"  `content` longtext,\n" +
+		"  `image` mediumblob,\n" +
+		"  `archive` longblob,\n" +
+		"  `amount` mediumint(9) DEFAULT NULL,\n" +
+		"  `born` year(4) DEFAULT NULL,\n" +
+		"  `birthday` date DEFAULT NULL,\n" +
+		"  `start` time DEFAULT NULL,\n" +
+		"  `updated` timestamp NULL DEFAULT NULL,\n" +
+		"  `visits` bigint(20) unsigned NOT NULL DEFAULT '0',\n" +
+		"  `level` tinyint unsigned DEFAULT NULL,\n" +
+		"  `status` enum('Active','in_progress','it''s') NOT NULL,\n" +
+		"  `roles` set('read','write') DEFAULT NULL,\n" +
+		"  `location` point NOT NULL /*!80003 SRID 4326 */,\n" +
+		"  `center` point /*!80003 SRID 4326 */,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  SPATIAL KEY `idx_types_model_location` (`location`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8")
+	if diff := local.Compare(remote); len(diff.ColumnChanged) != 0 || len(diff.AddColumn) != 0 ||
+		len(diff.DropColumn) != 0 || len(diff.AddPrimary) != 0 || len(diff.AddSpatialIndex) != 0 ||
+		len(diff.DropIndex) != 0 {
+		t.Fatalf("expect no diff, got %+v", diff)
+	}
+	if remote.Constraints["visits"] != "not null default '0'" {
+		t.Fatalf("unsigned should not be a constraint, got %s", remote.Constraints["visits"])
+	}
+	remote.ColumnTypes["code"] = "char(3)"
+	if diff := local.Compare(remote); len(diff.ColumnChanged) != 1 || diff.ColumnChanged[0].Column != "code" {
+		t.Fatalf("char length change not found, got %+v", diff)
+	}
+	remote.ColumnTypes["code"] = "char(2)"
+	remote.ColumnTypes["roles"] = "set('read')"
+	if diff := local.Compare(remote); len(diff.ColumnChanged) != 1 || diff.ColumnChanged[0].Column != "roles" {
+		t.Fatalf("set values change not found, got %+v", diff)
+	}
+	// 值中有空格
+	remote = Sql2Struct("CREATE TABLE `task` (\n  `state` enum('in progress','Done') DEFAULT NULL\n)")
+	if remote.ColumnTypes["state"] != "enum('in progress','Done')" || remote.Constraints["state"] != "default null" {
+		t.Fatalf("got %s %s", remote.ColumnTypes["state"], remote.Constraints["state"])
+	}
+}
+
+func TestUUIDStruct(t *testing.T)  {
+	local := Model2Struct(&Device{})
+	if local.ColumnTypes["id"] != "binary(16)" || local.ColumnTypes["serial"] != "binary(16)" {
+		t.Fatalf("got %v", local.ColumnTypes)
+	}
+	remote := Sql2Struct("CREATE TABLE `device` (\n" +
+		"  `id` binary(16) NOT NULL,\n" +
+		"  `serial` binary(16) DEFAULT NULL,\n" +
+		"  `name` varchar(50) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  KEY `idx_device_serial` (`serial`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8")
+	if diff := local.Compare(remote); len(diff.ColumnChanged) != 0 || len(diff.AddIndex) != 0 || len(diff.AddPrimary) != 0 {
+		t.Fatalf("expect no diff, got %+v", diff)
+	}
+}
+
+func TestSpatialIndexSql(t *testing.T)  {
+	local := Model2Struct(&Store{})
+	createSql := local.GenCreateTableSql("utf8mb4")
+	for _, want := range []string{"`location` point srid 4326 not null", "SPATIAL KEY `idx_store_location` (`location`)"} {
+		if !strings.Contains(createSql, want) {
+			t.Fatalf("%s not in %s", want, createSql)
+		}
+	}
+	remote := local
+	remote.SpatialIndexes = nil
+	columnSql := local.Compare(remote).GenColumnSql()
+	if len(columnSql) != 1 || columnSql[0] != "ALTER TABLE store ADD SPATIAL INDEX idx_store_location (`location`)" {
+		t.Fatalf("got %v", columnSql)
+	}
+	columnSql = remote.Compare(local).GenColumnSql()
+	if len(columnSql) != 1 || columnSql[0] != "ALTER TABLE store DROP INDEX idx_store_location" {
+		t.Fatalf("got %v", columnSql)
+	}
+}
@@ -4,6 +4,8 @@ type School struct {
 	ID    Varchar `mdb:"length:45 primary key"`
 	Title Varchar `mdb:"length:50"`
 	State Bool    `mdb:"index default null"`
+	// 关联
+	Classes []Class `mdb:"has_many:school_id"`
 }
 
 type Class struct {
@@ -11,6 +13,9 @@ type Class struct {
 	SchoolId Varchar `mdb:"length:45 not null"`
 	Number   Smallint
 	State    Bool `mdb:"index default 1"`
+	// 关联
+	School   School    `mdb:"belongs_to:school_id"`
+	Students []Student `mdb:"has_many:class_id"`
 }
 
 type Student struct {
@@ -20,6 +25,48 @@ type Student struct {
 	Score      Decimal `mdb:"length:10_2"`
 	CreateTime Datetime
 	State      Bool `mdb:"index default 1"`
+	// 关联
+	Class   *Class   `mdb:"belongs_to:class_id"`
+	Courses []Course `mdb:"many_to_many:student_course"`
+}
+
+type Course struct {
+	ID    Varchar `mdb:"length:45 primary key"`
+	Title Varchar `mdb:"length:50"`
+	// 关联
+	Students []Student `mdb:"many_to_many:student_course"`
+}
+
+type Profile struct {
+	ID       Varchar `mdb:"length:45 primary key"`
+	Settings JSON[ProfileSettings]
+	Status   Enum `mdb:"enum:active,disabled default 'active'"`
+	Roles    Set  `mdb:"set:read,write,admin"`
+}
+
+type ProfileSettings struct {
+	Theme string   `json:"theme"`
+	Tags  []string `json:"tags"`
+}
+
+type Store struct {
+	ID       Varchar `mdb:"length:45 primary key"`
+	Name     Varchar `mdb:"length:50"`
+	Location Point   `mdb:"spatial index"`
+}
+
+type Device struct {
+	ID     UUID        `mdb:"primary key"`
+	Serial OrderedUUID `mdb:"index"`
+	Name   Varchar     `mdb:"length:50"`
+}
+
+type Comment struct {
+	ID        Bigint  `mdb:"primary key auto_increment"`
+	StudentId Varchar `mdb:"length:45 index"`
+	Content   Text
+	CreatedAt Datetime
+	UpdatedAt Datetime
 }
 
 type TestModelA struct {
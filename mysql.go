@@ -3,9 +3,12 @@ package mdb
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
+	"math/rand"
 	"strings"
 	"time"
 )
@@ -25,6 +28,7 @@ const (
 
 // 全局对象，只在该文件出现
 var db *sql.DB
+var sqlxDb *sqlx.DB // db 的 sqlx 包装，InitDB 时创建，session 共用
 
 var currConf *Config
 type DealSession func(sess *Session) error
@@ -43,12 +47,18 @@ type Config struct {
 type Session struct {
 	Read *sqlx.DB
 	Write *sqlx.Tx
+	exec executor // Write 模式为事务，否则为 Read
+	depth int // 嵌套的层数，0 为最外层的事务
+	xa bool // XA 事务的分支，Write 为 nil，exec 为分支的连接
+	Attempt int // 第几次执行 deal，从 1 开始；使用 RetryPolicy 重试时递增
 }
 
 // TransModel 微事务数据库同步
 type TransModel struct {
 	TransId string
 	TimeoutCxt context.Context
+	OnDone func(result TransResult) // 事务结束时在等待的协程中调用
+	handle *TransHandle
 }
 
 // ModelValidator models中如果实现了这个接口，就会自动调；常见判断 status type 等是否是给定的值
@@ -98,108 +108,307 @@ func InitDB(conf Config) {
 		log.WithFields(logFields).Panic("mdb has been init...")
 		return
 	}
+	var err error
+	// 连接数据库 open + ping
+	db, err = OpenDB(conf)
+	if err != nil {
+		log.WithFields(logFields).Panicf("connect DB failed, err:%v\n", err)
+		return
+	}
+	sqlxDb = sqlx.NewDb(db, "mysql")
+	currConf = &conf
+}
+
+// OpenDB 按 conf 连接一个数据库，不影响全局的 db；用于 XA 等需要多个数据库的场景
+func OpenDB(conf Config) (*sql.DB, error) {
 	dsn := "$userName:$password@tcp($host)/$dbName?charset=utf8mb4&parseTime=True"
 	dsn = strings.Replace(dsn, "$userName", conf.UserName, 1)
 	dsn = strings.Replace(dsn, "$password", conf.Password, 1)
 	dsn = strings.Replace(dsn, "$dbName", conf.DbName, 1)
 	dsn = strings.Replace(dsn, "$host", conf.Host, 1)
-	var err error
-	// 连接数据库 open + ping
-	db, err = sql.Open("mysql", dsn)
+	conn, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.WithFields(logFields).Panicf("connect DB failed, err:%v\n", err)
-		return
+		return nil, err
 	}
 	// 最大连接数
-	db.SetMaxOpenConns(conf.MaxOpenConns)
+	conn.SetMaxOpenConns(conf.MaxOpenConns)
 	// 空闲链接数
-	db.SetMaxIdleConns(conf.MaxIdleConns)
-	currConf = &conf
+	conn.SetMaxIdleConns(conf.MaxIdleConns)
+	return conn, nil
 }
 
 //func ReadOnlyDb()  {
 //
 //}
 
+// SessionOption ObtainSession 的可选参数，比如 *TransModel
+type SessionOption interface {
+	apply(conf *sessionConf)
+}
+
+type sessionConf struct {
+	trans *TransModel
+	retry *RetryPolicy
+	tx *TxOptions
+}
+
+func (model *TransModel) apply(conf *sessionConf) {
+	conf.trans = model
+}
+
+// RetryPolicy Write 事务遇到死锁、锁等待超时等错误时，在新的事务中重新执行 deal
+// 零值使用默认配置：最多 3 次，退避 10ms 起每次翻倍，最长 1s，重试 1213 1205
+type RetryPolicy struct {
+	MaxAttempts int // 最多执行的次数，包括第一次
+	Backoff time.Duration // 第一次重试前等待的时间，之后每次翻倍，实际等待 [d/2, d] 中的随机值
+	MaxBackoff time.Duration
+	Codes []uint16 // 可以重试的 mysql 错误码
+}
+
+func (policy RetryPolicy) apply(conf *sessionConf) {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = 10 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = time.Second
+	}
+	if len(policy.Codes) == 0 {
+		policy.Codes = []uint16{1213, 1205} // 死锁，锁等待超时
+	}
+	conf.retry = &policy
+}
+
+// TxOptions 事务的隔离级别、只读和超时；ReadOnly 模式传入时开启只读的事务
+type TxOptions struct {
+	Isolation sql.IsolationLevel // 默认使用 mysql 的配置，一般为 REPEATABLE READ
+	ReadOnly bool
+	// ConsistentSnapshot 使用 START TRANSACTION WITH CONSISTENT SNAPSHOT 立即建立快照，用于报表等一致性读
+	// 只能和 REPEATABLE READ 一起使用
+	ConsistentSnapshot bool
+	// Timeout 超过时间后事务被回滚，之后的语句返回 sql.ErrTxDone；正在执行的语句不会被中断
+	Timeout time.Duration
+}
+
+func (opts TxOptions) apply(conf *sessionConf) {
+	if opts.ConsistentSnapshot && opts.Isolation != sql.LevelDefault && opts.Isolation != sql.LevelRepeatableRead {
+		log.Panicf("WITH CONSISTENT SNAPSHOT need REPEATABLE READ, not %v!", opts.Isolation)
+	}
+	conf.tx = &opts
+}
+
+// retryable 错误链中有 mysql 错误并且错误码可以重试
+func (policy *RetryPolicy) retryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	for _, code := range policy.Codes {
+		if mysqlErr.Number == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 第 attempt 次失败后等待的时间
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	d := policy.MaxBackoff
+	if attempt < 31 && policy.Backoff<<(attempt-1) < d {
+		d = policy.Backoff << (attempt - 1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Model 在 session 上执行的 builder，Write 模式时在事务中执行
+func (sess *Session) Model(models ...interface{}) *SqlBuilder {
+	sqlBuilder := Model(models...)
+	sqlBuilder.exec = sess.exec
+	return sqlBuilder
+}
+
 // ObtainSession 获取数据库 session；微事务同步 在这个方法中实现
-func ObtainSession(mode Mode, deal DealSession, model *TransModel) error {
-	var err error
-	//if model != nil && model.TransId != "" && mode == ReadOnly {
-	//	log.Panic("mode error! should be Write...")
-	//}
-	//if mode == Write {
-	//	var tx *sql.Tx
-	//	tx, err = db.Begin()
-	//	if err != nil {
-	//		log.Panicf("begin trans failed, err:%v\n", err)
-	//	}
-	//	defer func() {
-	//		// 捕获panic
-	//		if p := recover(); p != nil {  // 回滚
-	//			err = tx.Rollback()
-	//			log.Error(err.Error() + "\n" + string(util.PanicTrace(4))) // re-throw panic after Rollback
-	//		} else if err != nil {
-	//			log.Warning("---rollback")
-	//			err = tx.Rollback() // err is non-nil; don't change it
-	//		} else {
-	//			err = transCommit(tx, model)
-	//		}
-	//		if err != nil {
-	//			log.Warningf("end trans failed, err:%v\n", err)
-	//		}
-	//	}()
-	//	err = deal(&Session{Write: tx})
-	//	return err
-	//}
-	//err = deal(&Session{Read: db})
-	return err
+// Write 模式开启事务，deal 返回 nil 时提交，返回错误或者 panic 时回滚，panic 会继续抛出
+// 传入 TxOptions 时按其开启事务，ReadOnly 模式也会开启只读的事务
+// 传入 RetryPolicy 时，可以重试的错误会在新的事务中重新执行 deal，sess.Attempt 为第几次执行
+func ObtainSession(mode Mode, deal DealSession, opts ...SessionOption) (err error) {
+	conf := sessionConf{}
+	for _, opt := range opts {
+		if opt == nil {
+			continue // 兼容原来的 ObtainSession(mode, deal, nil)
+		}
+		opt.apply(&conf)
+	}
+	if conf.trans != nil && conf.trans.TransId != "" && mode == ReadOnly {
+		log.Panic("mode error! should be Write...")
+	}
+	if mode != Write && conf.tx == nil {
+		return deal(&Session{Read: sqlxDb, exec: sqlxDb, Attempt: 1})
+	}
+	txOpts := TxOptions{}
+	if conf.tx != nil {
+		txOpts = *conf.tx
+	}
+	txOpts.ReadOnly = txOpts.ReadOnly || mode != Write
+	if conf.trans != nil {
+		conf.trans.handle = newTransHandle(conf.trans.TransId)
+	}
+	for attempt := 1; ; attempt++ {
+		err = txSession(sqlxDb, deal, &conf, txOpts, attempt)
+		if err == nil || conf.retry == nil || attempt >= conf.retry.MaxAttempts || !conf.retry.retryable(err) {
+			if err != nil {
+				conf.trans.finish(TransRollback, err)
+			}
+			return err
+		}
+		wait := conf.retry.backoff(attempt)
+		log.Warningf("trans attempt %d failed, retry after %v, err:%v\n", attempt, wait, err)
+		time.Sleep(wait)
+	}
 }
 
-// getTransResult 从redis中获取微事务结果
-func getTransResult(transId string) int8 {
-	fmt.Println(transId, "TODO 从redis中获取")
-	return Pending
+// txSession 在一个新的事务中执行 deal
+func txSession(xdb *sqlx.DB, deal DealSession, conf *sessionConf, opts TxOptions, attempt int) (err error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+	// 微事务在协程中等待提交，超时需要一直有效
+	async := conf.trans != nil && conf.trans.TransId != ""
+	defer func() {
+		if !async || err != nil {
+			cancel()
+		}
+	}()
+	var tx *sqlx.Tx
+	if tx, err = beginTx(ctx, xdb, opts); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Warningf("rollback trans failed, err:%v\n", rbErr)
+			}
+			conf.trans.finish(TransRollback, fmt.Errorf("mdb: trans panic: %v", p))
+			panic(p)
+		}
+	}()
+	if err = deal(&Session{Read: xdb, Write: tx, exec: tx, Attempt: attempt}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Warningf("rollback trans failed, err:%v\n", rbErr)
+		}
+		return err
+	}
+	return transCommit(tx, conf.trans)
+}
+
+// beginTx Isolation 和 ReadOnly 由 driver 处理；CONSISTENT SNAPSHOT driver 不支持，
+// 在 driver 开启的事务中重新 START TRANSACTION，mysql 会隐式提交之前空的事务
+func beginTx(ctx context.Context, xdb *sqlx.DB, opts TxOptions) (*sqlx.Tx, error) {
+	if !opts.ConsistentSnapshot {
+		return xdb.BeginTxx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	}
+	tx, err := xdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{}
+	if opts.Isolation == sql.LevelRepeatableRead {
+		// 事务中不能修改隔离级别，先结束 driver 开启的事务
+		stmts = append(stmts, "ROLLBACK", "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+	}
+	start := "START TRANSACTION WITH CONSISTENT SNAPSHOT"
+	if opts.ReadOnly {
+		start += ", READ ONLY"
+	}
+	for _, stmt := range append(stmts, start) {
+		if _, err = tx.Exec(stmt); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// ObtainSession 在 session 中嵌套一个 session，用于组合各自开启 Write session 的方法
+// 外层是 Write 时内层使用 SAVEPOINT：失败或者 panic 只回滚到该 savepoint，成功时 release，提交由最外层决定
+// sess 为 nil 或者外层不是 Write 时，等同全局的 ObtainSession
+// XA 分支中不使用 savepoint，直接在分支中执行，内层失败时整个 XA 事务回滚
+func (sess *Session) ObtainSession(mode Mode, deal DealSession) (err error) {
+	if sess == nil || (sess.Write == nil && !sess.xa) {
+		return ObtainSession(mode, deal)
+	}
+	if mode != Write || sess.xa {
+		return deal(sess)
+	}
+	inner := &Session{Read: sess.Read, Write: sess.Write, exec: sess.exec, depth: sess.depth + 1, Attempt: sess.Attempt}
+	savepoint := fmt.Sprintf("mdb_sp_%d", inner.depth)
+	if _, err = sess.Write.Exec("SAVEPOINT " + savepoint); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if _, rbErr := sess.Write.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rbErr != nil {
+				log.Warningf("rollback to savepoint failed, err:%v\n", rbErr)
+			}
+			panic(p)
+		}
+	}()
+	if err = deal(inner); err != nil {
+		if _, rbErr := sess.Write.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rbErr != nil {
+			log.Warningf("rollback to savepoint failed, err:%v\n", rbErr)
+		}
+		return err
+	}
+	_, err = sess.Write.Exec("RELEASE SAVEPOINT " + savepoint)
+	return err
 }
 
 // transCommit  等待事务成功或失败，失败回滚
-// 内部启动协程，不阻塞
+// 内部启动协程，不阻塞；结果从 TransStatusStore 中获取，通过 model.Handle() 和 OnDone 通知
 func transCommit(tx *sqlx.Tx, model *TransModel) error {
 	if model == nil || model.TransId == "" {
-		return tx.Commit()
+		err := tx.Commit()
+		if err != nil {
+			model.finish(TransRollback, err) // 提交失败，写入没有生效
+		} else {
+			model.finish(TransCommit, nil)
+		}
+		return err
+	}
+	reg := deferredTrans
+	ctx, err := reg.add(model)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Warningf("transCommit %s rollback failed, err:%v\n", model.TransId, rbErr)
+		}
+		return err
 	}
 	// 启动协程，在协程中等待
 	go func () {
-		ticker := time.NewTicker(50 * time.Millisecond)
-		defer ticker.Stop()
-		// 等待结果，每50ms读取redis获取
-		for {
-			select {
-			case <-model.TimeoutCxt.Done():  // 超时回滚
-				err := tx.Rollback()
-				if err != nil {
-					log.Warningf("transCommit -end- trans failed, err:%v\n", err)
-				}
-				return
-			case <-ticker.C:
-				// 判断等待结果
-				switch status := getTransResult(model.TransId); status {
-				case Pending:
-					// do nothing...
-				case Success:
-					err := tx.Commit()
-					if err != nil {
-						log.Warningf("transCommit end trans failed, err:%v\n", err)
-					}
-					return
-				case Fail:
-					err := tx.Rollback()
-					if err != nil {
-						log.Warningf("transCommit end- trans failed, err:%v\n", err)
-					}
-					return
-				}
+		defer reg.remove(model.handle)
+		outcome := TransRollback
+		status, err := awaitTransResult(ctx, model.TransId)
+		switch {
+		case err != nil && model.TimeoutCxt != nil && model.TimeoutCxt.Err() != nil: // 超时回滚
+			outcome, err = TransTimeout, tx.Rollback()
+		case err != nil: // ShutdownTrans 回滚
+			if err = tx.Rollback(); err == nil {
+				err = ErrTransShutdown
 			}
+		case status == Success:
+			if err = tx.Commit(); err == nil { // 提交失败为 TransRollback
+				outcome = TransCommit
+			}
+		default:
+			err = tx.Rollback()
+		}
+		if err != nil && err != ErrTransShutdown {
+			log.Warningf("transCommit %s end trans failed, err:%v\n", model.TransId, err)
 		}
+		model.finish(outcome, err)
 	}()
 	return nil
 }
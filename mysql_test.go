@@ -0,0 +1,516 @@
+package mdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeDriver 记录执行的语句，不需要数据库就可以测试事务
+type fakeDriver struct{}
+
+var (
+	fakeMu   sync.Mutex
+	fakeLogs = map[string]*fakeLog{}
+	fakeSeq  int64
+)
+
+func init() {
+	sql.Register("mdbtest", fakeDriver{})
+}
+
+// fakeLog 一个 fake 数据库执行的语句；fail 返回错误时该语句失败，rows 为查询返回的结果，
+// result 为 Exec 的结果，没有设置时影响 1 行
+type fakeLog struct {
+	mu     sync.Mutex
+	stmts  []string
+	fail   func(stmt string) error
+	rows   func(stmt string) (columns []string, values [][]driver.Value)
+	result func(stmt string) driver.Result
+}
+
+func (l *fakeLog) add(stmt string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stmts = append(l.stmts, stmt)
+	if l.fail != nil {
+		return l.fail(stmt)
+	}
+	return nil
+}
+
+func (l *fakeLog) all() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.stmts...)
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+	return &fakeConn{log: fakeLogs[name]}, nil
+}
+
+type fakeConn struct {
+	log *fakeLog
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake: prepare not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	stmt := "BEGIN"
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		stmt += " ISOLATION " + sql.IsolationLevel(opts.Isolation).String()
+	}
+	if opts.ReadOnly {
+		stmt += " READ ONLY"
+	}
+	if err := c.log.add(stmt); err != nil {
+		return nil, err
+	}
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.log.add(query); err != nil {
+		return nil, err
+	}
+	if c.log.result != nil {
+		return c.log.result(query), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.log.add(query); err != nil {
+		return nil, err
+	}
+	rows := &fakeRows{}
+	if c.log.rows != nil {
+		rows.columns, rows.values = c.log.rows(query)
+	}
+	return rows, nil
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (tx fakeTx) Commit() error   { return tx.c.log.add("COMMIT") }
+func (tx fakeTx) Rollback() error { return tx.c.log.add("ROLLBACK") }
+
+// fakeRows 没有设置 rows 时返回空的结果
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// openFakeDb 一个新的 fake 数据库，测试结束时关闭
+func openFakeDb(t *testing.T) (*sql.DB, *fakeLog) {
+	name := fmt.Sprintf("fake-%d", atomic.AddInt64(&fakeSeq, 1))
+	l := &fakeLog{}
+	fakeMu.Lock()
+	fakeLogs[name] = l
+	fakeMu.Unlock()
+	fake, err := sql.Open("mdbtest", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fake.Close() })
+	return fake, l
+}
+
+// useFakeDb 测试期间全局的 db 替换为 fake 数据库
+func useFakeDb(t *testing.T) *fakeLog {
+	fake, l := openFakeDb(t)
+	old, oldSqlx := db, sqlxDb
+	db, sqlxDb = fake, sqlx.NewDb(fake, "mysql")
+	t.Cleanup(func() { db, sqlxDb = old, oldSqlx })
+	return l
+}
+
+// assertStmts 执行的语句依次以 want 开头，比如 BEGIN INSERT COMMIT
+func assertStmts(t *testing.T, l *fakeLog, want ...string) {
+	t.Helper()
+	got := l.all()
+	ok := len(got) == len(want)
+	for i := 0; ok && i < len(got); i++ {
+		ok = strings.HasPrefix(got[i], want[i])
+	}
+	if !ok {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+}
+
+func TestObtainSessionCommit(t *testing.T) {
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		stu := &Student{ID: NewVarchar("1"), Name: NewVarchar("a")}
+		if err := sess.Model(stu).Insert(); err != nil {
+			return err
+		}
+		up := &Student{Name: NewVarchar("b")}
+		if err := sess.Model(up).Where(up.ID.Eq("1")).Update(); err != nil {
+			return err
+		}
+		var stus []Student
+		if err := sess.Model(stu).Select(stu.ID).Map(&stus); err != nil {
+			return err
+		}
+		return sess.Model(stu).Where(stu.ID.Eq("1")).Delete()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "UPDATE", "SELECT", "DELETE", "COMMIT")
+}
+
+func TestObtainSessionRollback(t *testing.T) {
+	l := useFakeDb(t)
+	want := errors.New("deal failed")
+	err := ObtainSession(Write, func(sess *Session) error {
+		stu := &Student{ID: NewVarchar("1")}
+		if err := sess.Model(stu).Insert(); err != nil {
+			return err
+		}
+		return want
+	})
+	if err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+
+	// 语句执行失败时同样回滚
+	l = useFakeDb(t)
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "INSERT") {
+			return want
+		}
+		return nil
+	}
+	err = ObtainSession(Write, func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	})
+	if err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+}
+
+func TestObtainSessionPanic(t *testing.T) {
+	l := useFakeDb(t)
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recover = %v, want boom", p)
+		}
+		assertStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+	}()
+	_ = ObtainSession(Write, func(sess *Session) error {
+		_ = sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+		panic("boom")
+	})
+	t.Error("panic should be re-thrown")
+}
+
+func TestObtainSessionRead(t *testing.T) {
+	l := useFakeDb(t)
+	err := ObtainSession(ReadOnly, func(sess *Session) error {
+		stu := &Student{}
+		var stus []Student
+		return sess.Model(stu).Select(stu.ID).Map(&stus)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "SELECT")
+}
+
+func TestObtainSessionNilOption(t *testing.T) {
+	// 原来的调用方式 ObtainSession(Write, deal, nil)
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT INTO student", "COMMIT")
+
+	// 链式调用的错误 Delete 时返回，不执行
+	l.stmts = nil
+	stu := &Student{}
+	if err = Model(stu).Where(stu.ID.Eq("1")).After("", 0).Delete(); err == nil {
+		t.Error("Delete should return the builder error")
+	}
+	assertStmts(t, l)
+}
+
+func TestNestedSession(t *testing.T) {
+	l := useFakeDb(t)
+	fail := errors.New("inner failed")
+	err := ObtainSession(Write, func(sess *Session) error {
+		if err := sess.Model(&Student{ID: NewVarchar("1")}).Insert(); err != nil {
+			return err
+		}
+		// 第二层成功，其中的第三层失败只回滚第三层
+		err := sess.ObtainSession(Write, func(sess *Session) error {
+			if err := sess.Model(&Student{ID: NewVarchar("2")}).Insert(); err != nil {
+				return err
+			}
+			err := sess.ObtainSession(Write, func(sess *Session) error {
+				_ = sess.Model(&Student{ID: NewVarchar("3")}).Insert()
+				return fail
+			})
+			if err != fail {
+				t.Errorf("err = %v, want %v", err, fail)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// 同一层的第二个 savepoint
+		err = sess.ObtainSession(Write, func(sess *Session) error {
+			return fail
+		})
+		if err != fail {
+			t.Errorf("err = %v, want %v", err, fail)
+		}
+		// 内层的只读 session 直接使用外层的事务
+		return sess.ObtainSession(ReadOnly, func(sess *Session) error {
+			var stus []Student
+			stu := &Student{}
+			return sess.Model(stu).Select(stu.ID).Map(&stus)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l,
+		"BEGIN", "INSERT",
+		"SAVEPOINT mdb_sp_1", "INSERT",
+		"SAVEPOINT mdb_sp_2", "INSERT", "ROLLBACK TO SAVEPOINT mdb_sp_2",
+		"RELEASE SAVEPOINT mdb_sp_1",
+		"SAVEPOINT mdb_sp_1", "ROLLBACK TO SAVEPOINT mdb_sp_1",
+		"SELECT", "COMMIT")
+}
+
+func TestNestedSessionPanic(t *testing.T) {
+	// 外层 recover 内层的 panic 后继续执行并提交
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		func() {
+			defer func() {
+				if p := recover(); p != "boom" {
+					t.Errorf("recover = %v, want boom", p)
+				}
+			}()
+			_ = sess.ObtainSession(Write, func(sess *Session) error {
+				_ = sess.ObtainSession(Write, func(sess *Session) error {
+					_ = sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+					panic("boom")
+				})
+				return nil
+			})
+		}()
+		return sess.Model(&Student{ID: NewVarchar("2")}).Insert()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l,
+		"BEGIN",
+		"SAVEPOINT mdb_sp_1", "SAVEPOINT mdb_sp_2", "INSERT",
+		"ROLLBACK TO SAVEPOINT mdb_sp_2", "ROLLBACK TO SAVEPOINT mdb_sp_1",
+		"INSERT", "COMMIT")
+
+	// 没有被 recover 时整个事务回滚
+	l = useFakeDb(t)
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recover = %v, want boom", p)
+		}
+		assertStmts(t, l, "BEGIN", "SAVEPOINT mdb_sp_1", "ROLLBACK TO SAVEPOINT mdb_sp_1", "ROLLBACK")
+	}()
+	_ = ObtainSession(Write, func(sess *Session) error {
+		return sess.ObtainSession(Write, func(sess *Session) error {
+			panic("boom")
+		})
+	})
+	t.Error("panic should be re-thrown")
+}
+
+func TestNilSession(t *testing.T) {
+	// 没有外层 session 时开启新的事务
+	l := useFakeDb(t)
+	var sess *Session
+	err := sess.ObtainSession(Write, func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "COMMIT")
+}
+
+func TestObtainSessionRetry(t *testing.T) {
+	l := useFakeDb(t)
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+	inserts := 0
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "INSERT") {
+			if inserts++; inserts < 3 {
+				return deadlock
+			}
+		}
+		return nil
+	}
+	var attempts []int
+	policy := RetryPolicy{Backoff: time.Millisecond}
+	err := ObtainSession(Write, func(sess *Session) error {
+		attempts = append(attempts, sess.Attempt)
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(attempts) != "[1 2 3]" {
+		t.Errorf("attempts = %v", attempts)
+	}
+	assertStmts(t, l,
+		"BEGIN", "INSERT", "ROLLBACK",
+		"BEGIN", "INSERT", "ROLLBACK",
+		"BEGIN", "INSERT", "COMMIT")
+
+	// 超过最大次数返回最后的错误
+	l = useFakeDb(t)
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "INSERT") {
+			return &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+		}
+		return nil
+	}
+	err = ObtainSession(Write, func(sess *Session) error {
+		if err := sess.Model(&Student{ID: NewVarchar("1")}).Insert(); err != nil {
+			return fmt.Errorf("insert student: %w", err)
+		}
+		return nil
+	}, RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1205 {
+		t.Fatalf("err = %v, want 1205", err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "ROLLBACK", "BEGIN", "INSERT", "ROLLBACK")
+
+	// 不在 Codes 中的错误不重试
+	l = useFakeDb(t)
+	err = ObtainSession(Write, func(sess *Session) error {
+		return deadlock
+	}, RetryPolicy{Codes: []uint16{1205}})
+	if err != deadlock {
+		t.Fatalf("err = %v, want %v", err, deadlock)
+	}
+	assertStmts(t, l, "BEGIN", "ROLLBACK")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	conf := sessionConf{}
+	RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}.apply(&conf)
+	for attempt, max := range []time.Duration{10, 20, 40, 50, 50} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := conf.retry.backoff(attempt + 1); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %v, want [%v, %v]", attempt+1, d, max/2, max)
+			}
+		}
+	}
+	if d := conf.retry.backoff(100); d > 50*time.Millisecond {
+		t.Errorf("backoff(100) = %v", d)
+	}
+}
+
+func TestTxOptions(t *testing.T) {
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}, TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN ISOLATION Read Committed", "INSERT", "COMMIT")
+
+	// ReadOnly 模式传入 TxOptions 时开启只读事务
+	read := func(sess *Session) error {
+		stu := &Student{}
+		var stus []Student
+		return sess.Model(stu).Select(stu.ID).Map(&stus)
+	}
+	l = useFakeDb(t)
+	if err = ObtainSession(ReadOnly, read, TxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN READ ONLY", "SELECT", "COMMIT")
+
+	l = useFakeDb(t)
+	if err = ObtainSession(ReadOnly, read, TxOptions{ConsistentSnapshot: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY", "SELECT", "COMMIT")
+
+	l = useFakeDb(t)
+	err = ObtainSession(Write, read, TxOptions{Isolation: sql.LevelRepeatableRead, ConsistentSnapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "ROLLBACK", "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT", "SELECT", "COMMIT")
+
+	defer func() {
+		if p := recover(); p == nil {
+			t.Error("snapshot with SERIALIZABLE should panic")
+		}
+	}()
+	_ = ObtainSession(ReadOnly, read, TxOptions{Isolation: sql.LevelSerializable, ConsistentSnapshot: true})
+}
+
+func TestTxTimeout(t *testing.T) {
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		time.Sleep(50 * time.Millisecond)
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}, TxOptions{Timeout: 10 * time.Millisecond})
+	if err != sql.ErrTxDone {
+		t.Fatalf("err = %v, want %v", err, sql.ErrTxDone)
+	}
+	assertStmts(t, l, "BEGIN", "ROLLBACK")
+}
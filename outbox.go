@@ -0,0 +1,194 @@
+package mdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Outbox 事务发件箱：sess.Publish 和业务数据在同一个事务中写入，提交后由 OutboxDispatcher 投递
+// 需要在 ForceSync 时传入 &Outbox{} 创建表
+type Outbox struct {
+	ID          UUID    `mdb:"primary key"`
+	Topic       Varchar `mdb:"length:128 not null"`
+	Payload     MediumBlob
+	Status      Enum `mdb:"enum:pending,done,dead not null default 'pending' index"`
+	Attempts    Int  `mdb:"not null default 0"`
+	LastError   Text
+	AvailableAt Datetime `mdb:"index"` // 之后才会投递，重试时推迟
+	CreatedAt   Datetime
+}
+
+// Publish 在 session 的事务中写入 outbox，事务回滚时消息也不会投递
+// payload 为 []byte 或 string 时原样保存，其他的保存为 json
+func (sess *Session) Publish(topic string, payload interface{}) error {
+	if sess.Write == nil && !sess.xa {
+		log.Panicf("Publish %s: need Write session!", topic)
+	}
+	var data []byte
+	switch v := payload.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	return sess.Model(&Outbox{
+		ID:          NewUUID(UUIDv7()),
+		Topic:       NewVarchar(topic),
+		Payload:     NewMediumBlob(data),
+		Status:      NewEnum("pending"),
+		Attempts:    NewInt(0),
+		AvailableAt: NewDatetime(now),
+		CreatedAt:   NewDatetime(now),
+	}).Insert()
+}
+
+// OutboxMessage 投递给 sink 的消息，Attempts 为之前失败的次数
+type OutboxMessage struct {
+	ID        UUIDValue
+	Topic     string
+	Payload   []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// OutboxSink 投递消息，比如发送到 kafka；返回错误时稍后重试
+// 投递成功但是标记之前进程退出时会再次投递，sink 需要按 ID 去重
+type OutboxSink interface {
+	Deliver(ctx context.Context, msg OutboxMessage) error
+}
+
+// OutboxDeadLetterSink 可选，sink 实现时消息进入死信后调用
+type OutboxDeadLetterSink interface {
+	DeadLetter(ctx context.Context, msg OutboxMessage, err error) error
+}
+
+// OutboxDispatcher 使用 FOR UPDATE SKIP LOCKED 读取 pending 的消息，多个 dispatcher 可以同时运行
+type OutboxDispatcher struct {
+	Sink        OutboxSink
+	BatchSize   int           // 每个事务处理的条数，默认 100
+	Interval    time.Duration // 没有消息时的轮询间隔，默认 1s
+	MaxAttempts int           // 超过次数后 status 为 dead，默认 10
+	Backoff     time.Duration // 第一次重试前等待的时间，之后每次翻倍，默认 1s
+	MaxBackoff  time.Duration // 默认 10m
+}
+
+func NewOutboxDispatcher(sink OutboxSink) *OutboxDispatcher {
+	if sink == nil {
+		log.Panic("NewOutboxDispatcher: sink is nil!")
+	}
+	return &OutboxDispatcher{Sink: sink}
+}
+
+// Run 循环投递直到 ctx 结束，返回 ctx 的错误；单次失败只记录日志
+func (d *OutboxDispatcher) Run(ctx context.Context) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		n, err := d.DispatchOnce(ctx)
+		if err != nil {
+			log.Warningf("outbox dispatch failed, err:%v\n", err)
+		}
+		if err == nil && n >= d.batchSize() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue // 可能还有消息，不等待
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (d *OutboxDispatcher) batchSize() int {
+	if d.BatchSize <= 0 {
+		return 100
+	}
+	return d.BatchSize
+}
+
+// DispatchOnce 在一个事务中投递一批消息并标记结果，返回处理的条数
+func (d *OutboxDispatcher) DispatchOnce(ctx context.Context) (n int, err error) {
+	maxAttempts := d.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+	retry := RetryPolicy{Backoff: d.Backoff, MaxBackoff: d.MaxBackoff}
+	if retry.Backoff <= 0 {
+		retry.Backoff = time.Second
+	}
+	if retry.MaxBackoff <= 0 {
+		retry.MaxBackoff = 10 * time.Minute
+	}
+	err = ObtainSession(Write, func(sess *Session) error {
+		n = 0
+		msgs, err := lockOutbox(sess, d.batchSize())
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if ctx.Err() != nil {
+				break // 剩下的在提交后释放锁，下次处理
+			}
+			n++
+			deliverErr := d.Sink.Deliver(ctx, msg)
+			switch {
+			case deliverErr == nil:
+				_, err = sess.exec.Exec("UPDATE outbox SET status = 'done', attempts = attempts + 1, last_error = NULL WHERE id = ?", msg.ID[:])
+			case msg.Attempts+1 >= maxAttempts:
+				log.Warningf("outbox %s %s dead after %d attempts, err:%v\n", msg.Topic, msg.ID, msg.Attempts+1, deliverErr)
+				if deadSink, ok := d.Sink.(OutboxDeadLetterSink); ok {
+					if dlErr := deadSink.DeadLetter(ctx, msg, deliverErr); dlErr != nil {
+						log.Warningf("outbox %s %s dead letter failed, err:%v\n", msg.Topic, msg.ID, dlErr)
+					}
+				}
+				_, err = sess.exec.Exec("UPDATE outbox SET status = 'dead', attempts = attempts + 1, last_error = ? WHERE id = ?",
+					deliverErr.Error(), msg.ID[:])
+			default:
+				next := time.Now().Add(retry.backoff(msg.Attempts + 1))
+				_, err = sess.exec.Exec("UPDATE outbox SET attempts = attempts + 1, available_at = ?, last_error = ? WHERE id = ?",
+					next, deliverErr.Error(), msg.ID[:])
+			}
+			if err != nil {
+				return fmt.Errorf("mdb: mark outbox %s failed: %w", msg.ID, err)
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// lockOutbox 锁定到期的 pending 消息，其他 dispatcher 锁定的跳过
+func lockOutbox(sess *Session, limit int) ([]OutboxMessage, error) {
+	rows, err := sess.exec.Query("SELECT id, topic, payload, attempts, created_at FROM outbox "+
+		"WHERE status = 'pending' AND available_at <= ? ORDER BY available_at, id LIMIT ? FOR UPDATE SKIP LOCKED",
+		time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutboxMessage
+	for rows.Next() {
+		var ob Outbox
+		if err = rows.Scan(&ob.ID, &ob.Topic, &ob.Payload, &ob.Attempts, &ob.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, OutboxMessage{ID: ob.ID.V, Topic: ob.Topic.V, Payload: ob.Payload.V,
+			Attempts: int(ob.Attempts.V), CreatedAt: ob.CreatedAt.V})
+	}
+	return msgs, rows.Err()
+}
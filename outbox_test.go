@@ -0,0 +1,136 @@
+package mdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxPublish(t *testing.T) {
+	l := useFakeDb(t)
+	err := ObtainSession(Write, func(sess *Session) error {
+		if err := sess.Model(&Student{ID: NewVarchar("1")}).Insert(); err != nil {
+			return err
+		}
+		return sess.Publish("student.created", map[string]string{"id": "1"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT INTO student",
+		"INSERT INTO outbox(id,topic,payload,status,attempts,available_at,created_at)", "COMMIT")
+
+	// 事务回滚时消息一起回滚
+	l = useFakeDb(t)
+	want := errors.New("deal failed")
+	err = ObtainSession(Write, func(sess *Session) error {
+		if err := sess.Publish("student.created", "1"); err != nil {
+			return err
+		}
+		return want
+	})
+	if err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT INTO outbox", "ROLLBACK")
+
+	defer func() {
+		if p := recover(); p == nil {
+			t.Error("Publish in ReadOnly session should panic")
+		}
+	}()
+	_ = ObtainSession(ReadOnly, func(sess *Session) error {
+		return sess.Publish("student.created", "1")
+	})
+}
+
+type fakeSink struct {
+	delivered []string
+	dead      []string
+	fail      map[string]bool
+}
+
+func (sink *fakeSink) Deliver(ctx context.Context, msg OutboxMessage) error {
+	if sink.fail[msg.Topic] {
+		return errors.New("broker unavailable")
+	}
+	sink.delivered = append(sink.delivered, msg.Topic+":"+string(msg.Payload))
+	return nil
+}
+
+func (sink *fakeSink) DeadLetter(ctx context.Context, msg OutboxMessage, err error) error {
+	sink.dead = append(sink.dead, msg.Topic+":"+err.Error())
+	return nil
+}
+
+func TestOutboxDispatch(t *testing.T) {
+	l := useFakeDb(t)
+	now := time.Now()
+	row := func(topic string, attempts int64) []driver.Value {
+		id := UUIDv7()
+		return []driver.Value{id[:], []byte(topic), []byte(`{"id":"1"}`), attempts, now}
+	}
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"id", "topic", "payload", "attempts", "created_at"},
+			[][]driver.Value{row("ok", 0), row("retry", 0), row("dead", 9)}
+	}
+	sink := &fakeSink{fail: map[string]bool{"retry": true, "dead": true}}
+	d := NewOutboxDispatcher(sink)
+	n, err := d.DispatchOnce(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("n = %d, err = %v, want 3", n, err)
+	}
+	assertStmts(t, l, "BEGIN",
+		"SELECT id, topic, payload, attempts, created_at FROM outbox WHERE status = 'pending'",
+		"UPDATE outbox SET status = 'done'",
+		"UPDATE outbox SET attempts = attempts + 1, available_at = ?",
+		"UPDATE outbox SET status = 'dead'",
+		"COMMIT")
+	if !strings.HasSuffix(l.all()[1], "FOR UPDATE SKIP LOCKED") {
+		t.Errorf("select = %s, should lock with SKIP LOCKED", l.all()[1])
+	}
+	if strings.Join(sink.delivered, ",") != `ok:{"id":"1"}` {
+		t.Errorf("delivered = %v", sink.delivered)
+	}
+	if strings.Join(sink.dead, ",") != "dead:broker unavailable" {
+		t.Errorf("dead = %v", sink.dead)
+	}
+
+	// 标记失败时整批回滚，之后重新投递
+	l = useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"id", "topic", "payload", "attempts", "created_at"}, [][]driver.Value{row("ok", 0)}
+	}
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "UPDATE") {
+			return errors.New("lock wait timeout")
+		}
+		return nil
+	}
+	if _, err = d.DispatchOnce(context.Background()); err == nil {
+		t.Fatal("mark failure should fail")
+	}
+	assertStmts(t, l, "BEGIN", "SELECT", "UPDATE", "ROLLBACK")
+}
+
+func TestOutboxRun(t *testing.T) {
+	l := useFakeDb(t)
+	d := &OutboxDispatcher{Sink: &fakeSink{}, Interval: 5 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := d.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	selects := 0
+	for _, stmt := range l.all() {
+		if strings.HasPrefix(stmt, "SELECT") {
+			selects++
+		}
+	}
+	if selects < 2 {
+		t.Errorf("selects = %d, should poll again after Interval", selects)
+	}
+}
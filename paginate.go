@@ -0,0 +1,311 @@
+package mdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidCursor 游标无法解析，或者和当前 OrderBy 不匹配
+var ErrInvalidCursor = errors.New("mdb: invalid page cursor")
+
+// pageCursor 游标分页，values 为上一页最后一行的排序列的值
+type pageCursor struct {
+	keys   []string
+	values []interface{}
+	next   []interface{} // 本次查询最后一行的排序列的值，Cursor 使用
+}
+
+// cursorPayload 游标序列化结构，keys 用来校验游标是否属于当前查询
+type cursorPayload struct {
+	Keys   []string      `json:"k"`
+	Values []interface{} `json:"v"`
+}
+
+// cursorBytes []byte 的值编码为 {"b": base64}
+const cursorBytes = "b"
+
+// Paginate 分页查询，page 从 1 开始；dests 同 Map，返回满足条件的总条数
+// 总条数使用相同的 join where 做 COUNT，不带 order by
+// 有 join 时按主表记录分页：先按主键分页，再查询这些主表记录 join 出的所有行，排序只能使用主表的列
+func (sqlBuilder *SqlBuilder) Paginate(page, size int, dests ...interface{}) (total int64, err error) {
+	if sqlBuilder.err != nil {
+		return 0, sqlBuilder.err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("mdb: page size must be positive, got %d", size)
+	}
+	if page < 1 {
+		page = 1
+	}
+	countStmt := parseCountSql(sqlBuilder)
+	log.Info(countStmt, sqlBuilder.condValues)
+	if err = sqlBuilder.executor().QueryRow(countStmt, sqlBuilder.condValues...).Scan(&total); err != nil {
+		return 0, err
+	}
+	// 超出总数，不用再查询了
+	if int64((page-1)*size) >= total {
+		return total, nil
+	}
+	if len(sqlBuilder.JoinOns) != 0 {
+		if pk := getModelMeta(sqlBuilder.mainModel().Type()).primaryKey; pk != nil {
+			return total, sqlBuilder.paginateJoined(pk, page, size, dests)
+		}
+	}
+	sqlBuilder.limit = size
+	sqlBuilder.offset = (page - 1) * size
+	err = sqlBuilder.Map(dests...)
+	return
+}
+
+// paginateJoined join has_many 时一条主表记录对应多行，LIMIT 按行会把同一记录分到两页，页大小也和总数对不上
+func (sqlBuilder *SqlBuilder) paginateJoined(pk *fieldMeta, page, size int, dests []interface{}) error {
+	keyColumn := fmt.Sprintf("`%s`.%s", sqlBuilder.MainTable, pk.column)
+	keyStmt := fmt.Sprintf("SELECT %s FROM %s ", keyColumn, sqlBuilder.MainTable)
+	for _, joinOn := range sqlBuilder.JoinOns {
+		keyStmt += fmt.Sprintf("%s On %s ", joinOn.Join, joinOn.On)
+	}
+	if sqlBuilder.whereCons != "" {
+		keyStmt += " Where " + sqlBuilder.whereCons
+	}
+	keyStmt += " GROUP BY " + keyColumn
+	values := append([]interface{}(nil), sqlBuilder.condValues...)
+	if len(sqlBuilder.orderBys) != 0 {
+		orders := make([]string, len(sqlBuilder.orderBys))
+		for i, order := range sqlBuilder.orderBys {
+			if order.opt.tableName != sqlBuilder.MainTable {
+				return fmt.Errorf("mdb: Paginate with join can only order by %s columns, got %s",
+					sqlBuilder.MainTable, order.String())
+			}
+			orders[i] = order.String()
+			values = append(values, order.args...)
+		}
+		keyStmt += " ORDER BY " + strings.Join(orders, ", ")
+	}
+	keyStmt += fmt.Sprintf(" LIMIT %d OFFSET %d", size, (page-1)*size)
+	log.Info(keyStmt, values)
+	rows, err := sqlBuilder.executor().Query(keyStmt, values...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var keys []interface{}
+	for rows.Next() {
+		key := reflect.New(pk.typ)
+		if err = rows.Scan(key.Interface()); err != nil {
+			return err
+		}
+		keys = append(keys, columnRawValue(key.Interface()))
+	}
+	if err = rows.Err(); err != nil || len(keys) == 0 {
+		return err
+	}
+	cond, keyValues := assemble(pk.opt(sqlBuilder.mainModel()).In(keys...))
+	if sqlBuilder.whereCons != "" {
+		sqlBuilder.whereCons = "(" + sqlBuilder.whereCons + ") and " + strings.Join(cond, " ")
+	} else {
+		sqlBuilder.whereCons = strings.Join(cond, " ")
+	}
+	sqlBuilder.condValues = append(sqlBuilder.condValues, keyValues...)
+	return sqlBuilder.Map(dests...)
+}
+
+// After 游标分页，cursor 为上一页 Cursor() 的返回值，空字符串表示第一页
+// 排序依赖 OrderBy 的列，最后一列应当是唯一的（比如主键），排序列需要 not null
+func (sqlBuilder *SqlBuilder) After(cursor string, size int) *SqlBuilder {
+	if size <= 0 {
+		sqlBuilder.err = fmt.Errorf("mdb: page size must be positive, got %d", size)
+		return sqlBuilder
+	}
+	sqlBuilder.limit = size
+	sqlBuilder.offset = 0
+	sqlBuilder.cursor = &pageCursor{}
+	if cursor == "" {
+		return sqlBuilder
+	}
+	keys, values, err := decodeCursor(cursor)
+	if err != nil {
+		sqlBuilder.err = err
+		return sqlBuilder
+	}
+	sqlBuilder.cursor.keys = keys
+	sqlBuilder.cursor.values = values
+	return sqlBuilder
+}
+
+// Cursor Map 之后获取下一页的游标；没有下一页返回空字符串
+func (sqlBuilder *SqlBuilder) Cursor() string {
+	if sqlBuilder.cursor == nil || sqlBuilder.cursor.next == nil {
+		return ""
+	}
+	cursor, err := encodeCursor(orderKeys(sqlBuilder.orderBys), sqlBuilder.cursor.next)
+	if err != nil {
+		log.Warningf("encode cursor failed, err:%v\n", err)
+		return ""
+	}
+	return cursor
+}
+
+// prepareCursor 校验游标和 OrderBy 一致，并且保证排序列都在 select 中，scan 之后才能取到值
+func (sqlBuilder *SqlBuilder) prepareCursor() error {
+	if len(sqlBuilder.orderBys) == 0 {
+		return errors.New("mdb: After need OrderBy columns")
+	}
+	for _, order := range sqlBuilder.orderBys {
+		if order.expr != "" {
+			return errors.New("mdb: After can not order by expression")
+		}
+	}
+	keys := orderKeys(sqlBuilder.orderBys)
+	if sqlBuilder.cursor.values != nil {
+		if len(keys) != len(sqlBuilder.cursor.keys) {
+			return ErrInvalidCursor
+		}
+		for i, key := range keys {
+			if key != sqlBuilder.cursor.keys[i] {
+				return ErrInvalidCursor
+			}
+		}
+	}
+	for _, order := range sqlBuilder.orderBys {
+		if sqlBuilder.selectIndex(order.opt) == -1 {
+			sqlBuilder.SelectFields = append(sqlBuilder.SelectFields, selectField{tableName: order.opt.tableName,
+				columnName: order.opt.dbColumnName, orgColumnName: order.opt.orgColumnName})
+		}
+	}
+	sqlBuilder.cursor.next = nil
+	return nil
+}
+
+// recordCursor 查询到多取的一行时记录本页最后一行的排序列，values 为本页最后一行 scan 的地址
+func (sqlBuilder *SqlBuilder) recordCursor(values []interface{}) {
+	next := make([]interface{}, len(sqlBuilder.orderBys))
+	for i, order := range sqlBuilder.orderBys {
+		next[i] = columnRawValue(values[sqlBuilder.selectIndex(order.opt)])
+	}
+	sqlBuilder.cursor.next = next
+}
+
+func (sqlBuilder *SqlBuilder) selectIndex(opt Opt) int {
+	for i, field := range sqlBuilder.SelectFields {
+		if field.tableName == opt.tableName && field.columnName == opt.dbColumnName {
+			return i
+		}
+	}
+	return -1
+}
+
+// keysetCond 生成游标条件 (a > ?) or (a = ? and b > ?) ... 倒序的列使用 <
+func (cursor *pageCursor) keysetCond(orders []Order) (string, []interface{}) {
+	var ors []string
+	var values []interface{}
+	for i, order := range orders {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, orders[j].opt.column()+" = ?")
+			values = append(values, orders[j].opt.convert(cursor.values[j]))
+		}
+		op := ">"
+		if order.desc {
+			op = "<"
+		}
+		ands = append(ands, fmt.Sprintf("%s %s ?", order.opt.column(), op))
+		values = append(values, order.opt.convert(cursor.values[i]))
+		ors = append(ors, "("+strings.Join(ands, " and ")+")")
+	}
+	return "(" + strings.Join(ors, " or ") + ")", values
+}
+
+func orderKeys(orders []Order) []string {
+	keys := make([]string, len(orders))
+	for i, order := range orders {
+		keys[i] = order.opt.tableName + "." + order.opt.dbColumnName
+	}
+	return keys
+}
+
+// columnRawValue 获取 Varchar 等类型的值，unset 和 null 返回 nil
+func columnRawValue(dbVar interface{}) interface{} {
+	if column, ok := dbVar.(Column); ok {
+		return column.value()
+	}
+	return nil
+}
+
+// encodeCursor 排序列的值统一转换成 json 能够无损表达的形式，再 base64
+func encodeCursor(keys []string, values []interface{}) (string, error) {
+	payload := cursorPayload{Keys: keys, Values: make([]interface{}, len(values))}
+	for i, v := range values {
+		switch _v := v.(type) {
+		case time.Time:
+			payload.Values[i] = _v.Format("2006-01-02 15:04:05.999999")
+		case decimal.Decimal:
+			payload.Values[i] = _v.String()
+		case []byte: // binary 不一定是合法的 utf8，json 会替换掉，base64 后加上类型
+			payload.Values[i] = map[string]string{cursorBytes: base64.StdEncoding.EncodeToString(_v)}
+		case bool:
+			if _v {
+				payload.Values[i] = 1
+			} else {
+				payload.Values[i] = 0
+			}
+		default:
+			payload.Values[i] = v
+		}
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor 解析游标，数字保持精度；只接受字符串、数字和 []byte
+func decodeCursor(cursor string) (keys []string, values []interface{}, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	var payload cursorPayload
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(&payload); err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	if len(payload.Keys) == 0 || len(payload.Keys) != len(payload.Values) {
+		return nil, nil, ErrInvalidCursor
+	}
+	values = make([]interface{}, len(payload.Values))
+	for i, v := range payload.Values {
+		switch _v := v.(type) {
+		case json.Number:
+			if n, err := _v.Int64(); err == nil {
+				values[i] = n
+			} else {
+				values[i] = _v.String()
+			}
+		case string:
+			values[i] = _v
+		case map[string]interface{}:
+			s, ok := _v[cursorBytes].(string)
+			b, err := base64.StdEncoding.DecodeString(s)
+			if !ok || len(_v) != 1 || err != nil {
+				return nil, nil, ErrInvalidCursor
+			}
+			values[i] = b
+		default:
+			return nil, nil, ErrInvalidCursor
+		}
+	}
+	return payload.Keys, values, nil
+}
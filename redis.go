@@ -0,0 +1,229 @@
+package mdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisTransStore 使用 redis 协议的状态存储：状态为 SET key status EX ttl，同时 PUBLISH 到同名的 channel
+// 只实现了需要的几个命令，不依赖 redis 客户端
+type RedisTransStore struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string        // key 和 channel 的前缀，默认 mdb:trans:
+	TTL      time.Duration // 状态保存的时间，默认 24h
+	Timeout  time.Duration // 连接和读写的超时，默认 3s
+
+	mu   sync.Mutex
+	conn *redisConn // GET SET PUBLISH 共用的连接，出错后重新连接
+}
+
+func NewRedisTransStore(addr string) *RedisTransStore {
+	return &RedisTransStore{Addr: addr}
+}
+
+func (store *RedisTransStore) key(transId string) string {
+	if store.Prefix == "" {
+		return "mdb:trans:" + transId
+	}
+	return store.Prefix + transId
+}
+
+func (store *RedisTransStore) timeout() time.Duration {
+	if store.Timeout <= 0 {
+		return 3 * time.Second
+	}
+	return store.Timeout
+}
+
+func (store *RedisTransStore) GetStatus(transId string) (int8, error) {
+	reply, err := store.do("GET", store.key(transId))
+	if err != nil || reply == nil {
+		return Pending, err
+	}
+	return parseTransStatus(reply)
+}
+
+func (store *RedisTransStore) SetStatus(transId string, status int8) error {
+	ttl := store.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	value := strconv.Itoa(int(status))
+	if _, err := store.do("SET", store.key(transId), value, "EX", strconv.Itoa(int(ttl/time.Second))); err != nil {
+		return err
+	}
+	_, err := store.do("PUBLISH", store.key(transId), value)
+	return err
+}
+
+// Subscribe 使用单独的连接 SUBSCRIBE，ctx 结束时关闭连接
+func (store *RedisTransStore) Subscribe(ctx context.Context, transId string) (<-chan int8, error) {
+	conn, err := store.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.do(store.timeout(), "SUBSCRIBE", store.key(transId)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ch := make(chan int8, 1)
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			_ = conn.SetReadDeadline(time.Time{})
+			reply, err := conn.read()
+			if err != nil {
+				return
+			}
+			// 推送的消息为 ["message", channel, payload]
+			msg, ok := reply.([]interface{})
+			if !ok || len(msg) != 3 || msg[0] != "message" {
+				continue
+			}
+			if status, err := parseTransStatus(msg[2]); err == nil {
+				select {
+				case ch <- status:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (store *RedisTransStore) do(args ...string) (interface{}, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.conn == nil {
+		conn, err := store.dial()
+		if err != nil {
+			return nil, err
+		}
+		store.conn = conn
+	}
+	reply, err := store.conn.do(store.timeout(), args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// 连接的错误，下次重新连接；redis 返回的错误连接仍然可用
+		_ = store.conn.Close()
+		store.conn = nil
+	}
+	return reply, err
+}
+
+// dial 连接并且 AUTH SELECT
+func (store *RedisTransStore) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", store.Addr, store.timeout())
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	if store.Password != "" {
+		if _, err = conn.do(store.timeout(), "AUTH", store.Password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if store.DB != 0 {
+		if _, err = conn.do(store.timeout(), "SELECT", strconv.Itoa(store.DB)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func parseTransStatus(reply interface{}) (int8, error) {
+	s, ok := reply.(string)
+	if !ok {
+		return Pending, fmt.Errorf("mdb: unexpected trans status %v", reply)
+	}
+	status, err := strconv.ParseInt(s, 10, 8)
+	if err != nil || (status != Pending && status != Fail && status != Success) {
+		return Pending, fmt.Errorf("mdb: unexpected trans status %q", s)
+	}
+	return int8(status), nil
+}
+
+// redisError redis 返回的 -ERR 错误
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// redisConn RESP 协议的连接
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (conn *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg+"\r\n"...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+// read 读取一个回复：简单字符串和 bulk 为 string，整数为 int64，null 为 nil，数组为 []interface{}
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
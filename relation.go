@@ -0,0 +1,384 @@
+package mdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BelongsTo  = "belongs_to"
+	HasMany    = "has_many"
+	ManyToMany = "many_to_many"
+)
+
+// relation 结构体中通过 tag 声明的关联关系
+// belongs_to:class_id  外键在自己身上，指向关联表的主键，字段为 struct 或 *struct
+// has_many:class_id    外键在关联表上，指向自己的主键，字段为 []struct 或 []*struct
+// many_to_many:student_course  通过中间表关联，中间表的列为 表名_主键，如 student_id course_id
+type relation struct {
+	kind       string
+	foreignKey string
+	joinTable  string // many_to_many 的中间表
+	field      reflect.StructField
+	relType    reflect.Type // 关联表的结构体类型
+}
+
+// parseRelation 解析字段上的关联 tag，不是关联字段返回 false
+func parseRelation(f reflect.StructField) (rel relation, ok bool) {
+	for _, token := range strings.Split(f.Tag.Get("mdb"), " ") {
+		for _, kind := range []string{BelongsTo, HasMany, ManyToMany} {
+			if strings.HasPrefix(token, kind+":") {
+				rel.kind = kind
+				rel.foreignKey = strings.TrimPrefix(token, kind+":")
+				ok = true
+			}
+		}
+	}
+	if !ok {
+		return
+	}
+	if rel.kind == ManyToMany {
+		rel.joinTable, rel.foreignKey = rel.foreignKey, ""
+	}
+	rel.field = f
+	t := f.Type
+	if rel.kind != BelongsTo {
+		if t.Kind() != reflect.Slice {
+			log.Panicf("relation %s %s must be a slice!", rel.kind, f.Name)
+		}
+		t = t.Elem()
+	}
+	rel.relType = Deref(t)
+	if rel.relType.Kind() != reflect.Struct {
+		log.Panicf("relation %s must be a struct!", f.Name)
+	}
+	return
+}
+
+// primaryKeyField 获取主键字段，tag 中声明 primary key；没有声明的使用 ID
+func primaryKeyField(t reflect.Type) *fieldMeta {
+	pk := getModelMeta(t).primaryKey
+	if pk == nil {
+		log.Panicf("%s has no primary key!", t.Name())
+	}
+	return pk
+}
+
+// localKey 关联在当前表上依赖的列：belongs_to 是外键，has_many 是主键
+func (rel relation) localKey(owner reflect.Type) *fieldMeta {
+	if rel.kind == BelongsTo {
+		f, ok := getModelMeta(owner).byColumn[rel.foreignKey]
+		if !ok {
+			log.Panicf("%s has no column %s!", owner.Name(), rel.foreignKey)
+		}
+		return f
+	}
+	return primaryKeyField(owner)
+}
+
+// remoteKey 关联表上用来匹配的列：belongs_to many_to_many 是主键，has_many 是外键
+func (rel relation) remoteKey() *fieldMeta {
+	if rel.kind != HasMany {
+		return primaryKeyField(rel.relType)
+	}
+	f, ok := getModelMeta(rel.relType).byColumn[rel.foreignKey]
+	if !ok {
+		log.Panicf("%s has no column %s!", rel.relType.Name(), rel.foreignKey)
+	}
+	return f
+}
+
+// getRelation 从缓存的元信息中获取关联字段
+func getRelation(owner reflect.Type, name string) (relation, error) {
+	rel, ok := getModelMeta(owner).relations[name]
+	if !ok {
+		return rel, fmt.Errorf("%s.%s is not a relation", owner.Name(), name)
+	}
+	return rel, nil
+}
+
+// joinColumns many_to_many 中间表的两列，分别指向 owner 和关联表的主键
+func (rel relation) joinColumns(owner reflect.Type) (ownerColumn, relColumn string) {
+	if owner == rel.relType {
+		log.Panicf("many_to_many %s can not relate to itself!", rel.field.Name)
+	}
+	ownerColumn = tableName(owner) + "_" + primaryKeyField(owner).column
+	relColumn = tableName(rel.relType) + "_" + primaryKeyField(rel.relType).column
+	return
+}
+
+// Preload 预加载关联字段，多层使用 . 分隔，如 Preload("Class.School")
+// Map 之后按层批量 IN 查询，关联字段的 tag 见 relation
+func (sqlBuilder *SqlBuilder) Preload(paths ...string) *SqlBuilder {
+	sqlBuilder.preloads = append(sqlBuilder.preloads, paths...)
+	return sqlBuilder
+}
+
+// mainModel 获取主表对应的 model 指针
+func (sqlBuilder *SqlBuilder) mainModel() reflect.Value {
+	for model, tableName := range sqlBuilder.Models {
+		if tableName == sqlBuilder.MainTable {
+			return reflect.ValueOf(model).Elem()
+		}
+	}
+	log.Panicf("main table %s not in Model!", sqlBuilder.MainTable)
+	return reflect.Value{}
+}
+
+// preparePreload 关联依赖的列需要在 select 中
+func (sqlBuilder *SqlBuilder) preparePreload() {
+	model := sqlBuilder.mainModel()
+	for _, path := range sqlBuilder.preloads {
+		rel, err := getRelation(model.Type(), strings.Split(path, ".")[0])
+		if err != nil {
+			log.Panicf("Preload: %v!", err)
+		}
+		opt := rel.localKey(model.Type()).opt(model)
+		if sqlBuilder.selectIndex(*opt) == -1 {
+			sqlBuilder.SelectFields = append(sqlBuilder.SelectFields, selectField{tableName: opt.tableName,
+				columnName: opt.dbColumnName, orgColumnName: opt.orgColumnName})
+		}
+	}
+}
+
+// doPreload Map 之后执行，dests 中找到主表对应的数组
+func (sqlBuilder *SqlBuilder) doPreload(dests ...interface{}) error {
+	for _, dest := range dests {
+		slice := reflect.Indirect(reflect.ValueOf(dest))
+		if tableName(Deref(slice.Type().Elem())) != sqlBuilder.MainTable {
+			continue
+		}
+		parents := make([]reflect.Value, 0, slice.Len())
+		for i := 0; i < slice.Len(); i++ {
+			parents = append(parents, reflect.Indirect(slice.Index(i)))
+		}
+		return preload(sqlBuilder.executor(), parents, sqlBuilder.preloads)
+	}
+	return nil
+}
+
+// preload 按第一层分组，同一个关联只查询一次，再递归处理下一层
+func preload(exec executor, parents []reflect.Value, paths []string) error {
+	if len(parents) == 0 {
+		return nil
+	}
+	var names []string
+	children := make(map[string][]string)
+	for _, path := range paths {
+		_array := strings.SplitN(path, ".", 2)
+		if _, ok := children[_array[0]]; !ok {
+			names = append(names, _array[0])
+			children[_array[0]] = nil
+		}
+		if len(_array) == 2 {
+			children[_array[0]] = append(children[_array[0]], _array[1])
+		}
+	}
+	owner := parents[0].Type()
+	for _, name := range names {
+		rel, err := getRelation(owner, name)
+		if err != nil {
+			return fmt.Errorf("preload: %v", err)
+		}
+		loaded, err := rel.load(exec, owner, parents)
+		if err != nil {
+			return err
+		}
+		if err = preload(exec, loaded, children[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load 批量查询关联表并赋值给 parents，返回赋值后的关联对象，供下一层使用
+func (rel relation) load(exec executor, owner reflect.Type, parents []reflect.Value) ([]reflect.Value, error) {
+	localKey, remoteKey := rel.localKey(owner), rel.remoteKey()
+	var keys []interface{}
+	parentKeys := make([]interface{}, len(parents))
+	seen := make(map[interface{}]bool)
+	for i, parent := range parents {
+		key, err := rel.parentKey(localKey, remoteKey, parent)
+		if err != nil {
+			return nil, err
+		}
+		parentKeys[i] = key
+		if key == nil || seen[mapKey(key)] {
+			continue
+		}
+		seen[mapKey(key)] = true
+		keys = append(keys, key)
+	}
+	var loaded []reflect.Value
+	if len(keys) == 0 {
+		return loaded, nil
+	}
+	// many_to_many 先查中间表，换成关联表的主键
+	var links map[interface{}][]interface{}
+	if rel.kind == ManyToMany {
+		var err error
+		if links, keys, err = rel.loadLinks(exec, owner, keys); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return loaded, nil
+		}
+	}
+	results, err := selectIn(exec, rel.relType, remoteKey, keys)
+	if err != nil {
+		return nil, err
+	}
+	grouped := make(map[interface{}][]reflect.Value)
+	for i := 0; i < results.Len(); i++ {
+		key := mapKey(remoteKey.value(results.Index(i)))
+		grouped[key] = append(grouped[key], results.Index(i))
+	}
+	if rel.kind == ManyToMany {
+		byOwner := make(map[interface{}][]reflect.Value)
+		for ownerKey, relKeys := range links {
+			for _, relKey := range relKeys {
+				byOwner[ownerKey] = append(byOwner[ownerKey], grouped[mapKey(relKey)]...)
+			}
+		}
+		grouped = byOwner
+	}
+	for i, parent := range parents {
+		key := mapKey(parentKeys[i])
+		field := parent.FieldByIndex(rel.field.Index)
+		if rel.kind == BelongsTo {
+			if len(grouped[key]) == 0 {
+				continue
+			}
+			if field.Kind() == reflect.Ptr {
+				field.Set(reflect.New(rel.relType))
+				field = field.Elem()
+			}
+			field.Set(grouped[key][0])
+			loaded = append(loaded, field)
+			continue
+		}
+		items := reflect.MakeSlice(field.Type(), 0, len(grouped[key]))
+		for _, item := range grouped[key] {
+			if field.Type().Elem().Kind() == reflect.Ptr {
+				ptr := reflect.New(rel.relType)
+				ptr.Elem().Set(item)
+				item = ptr
+			}
+			items = reflect.Append(items, item)
+		}
+		field.Set(items)
+		for i := 0; i < field.Len(); i++ {
+			loaded = append(loaded, reflect.Indirect(field.Index(i)))
+		}
+	}
+	return loaded, nil
+}
+
+// parentKey parent 上的键转换为关联列的类型，如 Int 的外键和 Bigint 的主键，保证可以比较；
+// many_to_many 中间表按 owner 主键的类型 scan，不需要转换
+func (rel relation) parentKey(localKey, remoteKey *fieldMeta, parent reflect.Value) (interface{}, error) {
+	key := localKey.value(parent)
+	if key == nil || rel.kind == ManyToMany || localKey.typ == remoteKey.typ {
+		return key, nil
+	}
+	v, err := localKey.columnOf(parent).Value()
+	if err != nil {
+		return nil, err
+	}
+	column := reflect.New(remoteKey.typ).Interface().(Column)
+	if err = column.Scan(v); err != nil {
+		return nil, fmt.Errorf("preload %s: %v", rel.field.Name, err)
+	}
+	return column.value(), nil
+}
+
+// loadLinks 查询中间表，返回 owner 主键 -> 关联表主键（经过 mapKey），以及去重后的关联表主键
+// 中间表的值使用对应主键的类型 scan，保证和 columnRawValue 的结果可以比较
+func (rel relation) loadLinks(exec executor, owner reflect.Type, keys []interface{}) (links map[interface{}][]interface{},
+	relKeys []interface{}, err error) {
+	ownerColumn, relColumn := rel.joinColumns(owner)
+	signs := make([]string, len(keys))
+	for i := range keys {
+		signs[i] = "?"
+	}
+	_sql := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IN (%s)",
+		ownerColumn, relColumn, rel.joinTable, ownerColumn, strings.Join(signs, ","))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = primaryKeyField(owner).convert(key)
+	}
+	log.Info(_sql, args)
+	rows, err := exec.Query(_sql, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	links = make(map[interface{}][]interface{})
+	seen := make(map[interface{}]bool)
+	for rows.Next() {
+		ownerKey := reflect.New(primaryKeyField(owner).typ)
+		relKey := reflect.New(primaryKeyField(rel.relType).typ)
+		if err = rows.Scan(ownerKey.Interface(), relKey.Interface()); err != nil {
+			return nil, nil, err
+		}
+		_ownerKey, _relKey := columnRawValue(ownerKey.Interface()), columnRawValue(relKey.Interface())
+		links[mapKey(_ownerKey)] = append(links[mapKey(_ownerKey)], _relKey)
+		if !seen[mapKey(_relKey)] {
+			seen[mapKey(_relKey)] = true
+			relKeys = append(relKeys, _relKey)
+		}
+	}
+	return links, relKeys, rows.Err()
+}
+
+// JoinTableStructs many_to_many 关联的中间表，ForceSync 使用；中间表的两列联合主键
+func JoinTableStructs(model interface{}) (tableStructs []TableStruct) {
+	owner := Deref(reflect.TypeOf(model))
+	for _, rel := range getModelMeta(owner).relations {
+		if rel.kind != ManyToMany {
+			continue
+		}
+		ownerColumn, relColumn := rel.joinColumns(owner)
+		ownerStruct := Model2Struct(reflect.New(owner).Interface())
+		relStruct := Model2Struct(reflect.New(rel.relType).Interface())
+		tableStructs = append(tableStructs, TableStruct{
+			TableName:   rel.joinTable,
+			Columns:     []string{ownerColumn, relColumn},
+			PrimaryKeys: []string{ownerColumn, relColumn},
+			Indexes:     []string{relColumn},
+			ColumnTypes: map[string]string{
+				ownerColumn: ownerStruct.ColumnTypes[primaryKeyField(owner).column],
+				relColumn:   relStruct.ColumnTypes[primaryKeyField(rel.relType).column],
+			},
+			Constraints: map[string]string{ownerColumn: "not null", relColumn: "not null"},
+		})
+	}
+	return
+}
+
+// selectIn 查询 t 对应表的所有列，条件为 key in (keys)
+func selectIn(exec executor, t reflect.Type, key *fieldMeta, keys []interface{}) (reflect.Value, error) {
+	model := reflect.New(t)
+	sqlBuilder := Model(model.Interface())
+	sqlBuilder.exec = exec
+	var columns []interface{}
+	for _, field := range getModelMeta(t).fields {
+		if field.isColumn() {
+			columns = append(columns, model.Elem().FieldByIndex(field.index).Interface())
+		}
+	}
+	keyOpt := key.opt(model.Elem())
+	results := reflect.New(reflect.SliceOf(t))
+	err := sqlBuilder.Select(columns...).Where(keyOpt.In(keys...)).Map(results.Interface())
+	return results.Elem(), err
+}
+
+// tableName 结构体类型对应的表名
+func tableName(t reflect.Type) string {
+	return getModelMeta(t).tableName
+}
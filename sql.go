@@ -1,11 +1,12 @@
 package mdb
 
 import (
+	"database/sql"
 	"fmt"
-	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 	"reflect"
 	"strings"
+	"time"
 )
 
 
@@ -22,6 +23,32 @@ type SqlBuilder struct {
 	InsertFields []insertField
 	SqlStmt string  // 最后执行的sql语句
 	Values []interface{}  // 替换sql 语句中的？ 防止sql注入
+	condValues []interface{} // join on 和 where 的参数，select count 在此基础上组装，重复执行不会累加
+	// order by limit 分页使用
+	orderBys []Order
+	limit    int
+	offset   int
+	// 游标分页，After 设置
+	cursor   *pageCursor
+	preloads []string // 预加载的关联字段
+	collapse *collapser
+	err      error    // 链式调用中产生的错误，在执行时返回
+	valueErr error    // 列的 Valuer 出错，只有 Insert Upsert Update 返回，Model 只用于查询时忽略
+	exec     executor // 为 nil 时使用全局的 db，Session.Model 时为事务
+}
+
+// executor *sql.DB 或者事务，builder 在上面执行
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (sqlBuilder *SqlBuilder) executor() executor {
+	if sqlBuilder.exec == nil {
+		return db
+	}
+	return sqlBuilder.exec
 }
 
 type joinOnCell struct {
@@ -33,6 +60,7 @@ type selectField struct {
 	tableName string
 	columnName string
 	orgColumnName string
+	index []int // dest 结构体中的字段位置，checkDest 时赋值
 }
 
 type insertField struct {
@@ -50,7 +78,10 @@ func Model(models ...interface{}) *SqlBuilder {
 	modelsMap := make(map[interface{}]string)
 	var sqlBuilder SqlBuilder
 	for _, model := range models {
-		tableName, insertFields := dealModel(model)
+		tableName, insertFields, err := dealModel(model)
+		if err != nil && sqlBuilder.valueErr == nil {
+			sqlBuilder.valueErr = err
+		}
 		modelsMap[model] = tableName
 		if len(insertFields) != 0 {  // insert 的时候只会有 一个 model
 			sqlBuilder.InsertFields = insertFields
@@ -62,181 +93,49 @@ func Model(models ...interface{}) *SqlBuilder {
 }
 
 // dealModel 初始化值 dbVarchar 等等的 初始值
-func dealModel(obj interface{}) (tableName string, insertFields []insertField) {
-	refType := reflect.TypeOf(obj).Elem()
+func dealModel(obj interface{}) (tableName string, insertFields []insertField, err error) {
 	refValue := reflect.ValueOf(obj).Elem()
-	_array := strings.Split(refType.String(), ".")
-	tableName = UnMarshal4Camel(_array[len(_array)-1])
-	if refValue.Kind() == reflect.Struct {
-		// 结构体字段获取
-		for i := 0; i < refType.NumField(); i++ {
-			f := refType.Field(i)
-			if f.Name[0] < "A"[0] || f.Name[0] > "Z"[0]  {
-				continue
-			}
-			//fmt.Printf("name=%s , type=%v , value=%v \n", f.Name, f.Type, refValue.Field(i).Interface())
-			_columnName := refType.Field(i).Name
-			columnName := UnMarshal4Camel(_columnName)
-			dbVar, value := setOptValue(refValue.Field(i).Interface(), tableName, columnName, _columnName)
-			if dbVar != nil {
-				refValue.FieldByName(refType.Field(i).Name).Set(reflect.ValueOf(dbVar))
-			}
-			if value != nil {  // 用于 insert 更新取值
-				insertFields = append(insertFields, insertField{
-					columnName: columnName,
-					value:      value,
-				})
-			}
-		}
-	}
-	return
-}
-
-// setOptValue 核心方法，给结构体赋值 tableName columnName，方便后期直接使用
-func setOptValue(value interface{}, tableName,
-	dbColumnName, orgColumnName string) (interface{}, interface{}) {
-	var v interface{}
-	if varchar, ok := value.(Varchar); ok {
-		varchar.tableName =  tableName
-		varchar.dbColumnName = dbColumnName
-		varchar.orgColumnName = orgColumnName
-		v = varchar.V
-		if varchar.V == "" && !varchar.NotNul {
-			v = nil
-		} else {
-			v = fmt.Sprintf("%s", v)
+	meta := getModelMeta(refValue.Type())
+	tableName = meta.tableName
+	// 结构体字段获取，给每个列赋值 tableName columnName，方便后期直接使用
+	for _, field := range meta.fields {
+		if !field.isColumn() {
+			continue
 		}
-		return varchar, v
-	} else if text, ok := value.(Text); ok {
-		text.tableName =  tableName
-		text.dbColumnName = dbColumnName
-		text.orgColumnName = orgColumnName
-		v = text.V
-		if text.V == "" && !text.NotNul {
-			v = nil
-		} else {
-			v = fmt.Sprintf("%s", v)
+		opt := field.opt(refValue)
+		opt.tableName = tableName
+		opt.dbColumnName = field.column
+		opt.orgColumnName = field.name
+		opt.arg = field.arg
+		// 用于 insert 更新取值；unset 的列忽略，显式 null 的写入 NULL
+		column := field.columnOf(refValue)
+		if column.State() == StateUnset {
+			continue
 		}
-		return text, v
-	} else if blob, ok := value.(Blob); ok {
-		blob.tableName =  tableName
-		blob.dbColumnName = dbColumnName
-		blob.orgColumnName = orgColumnName
-		v = blob.V
-		if len(blob.V) == 0 && !blob.NotNul {
-			v = nil
+		// 通过 driver.Valuer 取值，time json 等类型的 V 不能直接交给 driver；出错的记录第一个，其他列继续处理
+		value, valueErr := column.Value()
+		if valueErr == nil {
+			valueErr = field.validate(value)
 		}
-		return blob, v
-	} else if tinyint, ok := value.(Tinyint); ok {
-		tinyint.tableName =  tableName
-		tinyint.dbColumnName = dbColumnName
-		tinyint.orgColumnName = orgColumnName
-		v = tinyint.V
-		if tinyint.V == 0 && !tinyint.NotNul {
-			v = nil
-		}
-		return tinyint, v
-	} else if smallint, ok := value.(Smallint); ok {
-		smallint.tableName =  tableName
-		smallint.dbColumnName = dbColumnName
-		smallint.orgColumnName = orgColumnName
-		v = smallint.V
-		if smallint.V == 0 && !smallint.NotNul {
-			v = nil
-		}
-		return smallint, v
-	} else if integer, ok := value.(Int); ok {
-		integer.tableName =  tableName
-		integer.dbColumnName = dbColumnName
-		integer.orgColumnName = orgColumnName
-		v = integer.V
-		if integer.V == 0 && !integer.NotNul {
-			v = nil
-		}
-		return integer, nil
-	} else if bigint, ok := value.(Bigint); ok {
-		bigint.tableName =  tableName
-		bigint.dbColumnName = dbColumnName
-		bigint.orgColumnName = orgColumnName
-		v = bigint.V
-		if bigint.V == 0 && !bigint.NotNul {
-			v = nil
-		}
-		return bigint, v
-	} else if float, ok := value.(Float); ok {
-		float.tableName =  tableName
-		float.dbColumnName = dbColumnName
-		float.orgColumnName = orgColumnName
-		v = float.V
-		if float.V == 0 && !float.NotNul {
-			v = nil
-		}
-		return float, v
-	} else if double, ok := value.(Double); ok {
-		double.tableName =  tableName
-		double.dbColumnName = dbColumnName
-		double.orgColumnName = orgColumnName
-		v = double.V
-		if double.V == 0 && !double.NotNul {
-			v = nil
-		}
-		return double, v
-	} else if deci, ok := value.(Decimal); ok {
-		deci.tableName =  tableName
-		deci.dbColumnName = dbColumnName
-		deci.orgColumnName = orgColumnName
-		v = deci.V
-		if deci.V.Equal(decimal.Zero) && !deci.NotNul {
-			v = nil
-		}
-		return deci, v
-	} else if datetime, ok := value.(Datetime); ok {
-		datetime.tableName =  tableName
-		datetime.dbColumnName = dbColumnName
-		datetime.orgColumnName = orgColumnName
-		v = datetime.V
-		if datetime.V.IsZero() && !deci.NotNul {
-			v = nil
-		}
-		return datetime, v
-	} else if _bool, ok := value.(Bool); ok {
-		_bool.tableName =  tableName
-		_bool.dbColumnName = dbColumnName
-		_bool.orgColumnName = orgColumnName
-		v = _bool.V
-		if !_bool.V && !_bool.NotNul {
-			v = nil
+		if valueErr != nil {
+			if err == nil {
+				err = valueErr
+			}
+			continue
 		}
-		return _bool, v
+		insertFields = append(insertFields, insertField{
+			columnName: field.column,
+			value:      value,
+		})
 	}
-	return nil, v
+	return
 }
 
+// getOpt 获取列类型上的 Opt，不是列类型返回 nil
 func getOpt(value interface{}) *Opt {
-	if varchar, ok := value.(Varchar); ok {
-		return &varchar.Opt
-	} else if text, ok := value.(Text); ok {
-		return &text.Opt
-	} else if blob, ok := value.(Blob); ok {
-		return &blob.Opt
-	} else if tinyint, ok := value.(Tinyint); ok {
-		return &tinyint.Opt
-	} else if smallint, ok := value.(Smallint); ok {
-		return &smallint.Opt
-	} else if integer, ok := value.(Int); ok {
-		return &integer.Opt
-	} else if bigint, ok := value.(Bigint); ok {
-		return &bigint.Opt
-	} else if float, ok := value.(Float); ok {
-		return &float.Opt
-	} else if double, ok := value.(Double); ok {
-		return &double.Opt
-	} else if deci, ok := value.(Decimal); ok {
-		return &deci.Opt
-	} else if datetime, ok := value.(Datetime); ok {
-		return &datetime.Opt
-	} else if _bool, ok := value.(Bool); ok {
-		return &_bool.Opt
+	if holder, ok := value.(interface{ option() Opt }); ok {
+		opt := holder.option()
+		return &opt
 	}
 	return nil
 }
@@ -248,53 +147,236 @@ func (sqlBuilder *SqlBuilder) Select(opts ...interface{}) *SqlBuilder {
 	return sqlBuilder
 }
 
+// OrderBy 排序，参数为 model 的字段或者 Opt.Desc() Opt.Asc()，默认正序
+func (sqlBuilder *SqlBuilder) OrderBy(orders ...interface{}) *SqlBuilder {
+	for _, order := range orders {
+		if o, ok := order.(Order); ok {
+			sqlBuilder.orderBys = append(sqlBuilder.orderBys, o)
+			continue
+		}
+		opt := getOpt(order)
+		if opt == nil {
+			log.Panicf("OrderBy: %T is not a model field!", order)
+		}
+		sqlBuilder.orderBys = append(sqlBuilder.orderBys, opt.Asc())
+	}
+	return sqlBuilder
+}
+
+// writeErr 写入前检查：链式调用的错误，或者列取值的错误
+func (sqlBuilder *SqlBuilder) writeErr() error {
+	if sqlBuilder.err != nil {
+		return sqlBuilder.err
+	}
+	return sqlBuilder.valueErr
+}
+
 func (sqlBuilder *SqlBuilder) Insert() error {
+	_, err := sqlBuilder.insert()
+	return err
+}
+
+// insert 同 Insert，返回 sql.Result，自增主键等需要
+func (sqlBuilder *SqlBuilder) insert() (sql.Result, error) {
 	if len(sqlBuilder.Models) != 1 {
 		log.Panic("Insert option has one table a time!")
 	}
 	var tableName string
 	//var model interface{}
 	for _, tableName = range sqlBuilder.Models {}
+	if err := sqlBuilder.writeErr(); err != nil {
+		return nil, err
+	}
 	sqlBuilder.MainTable = tableName
 	parseInsertSql(sqlBuilder)
 	log.Info(sqlBuilder.SqlStmt, sqlBuilder.Values)
-	_, err := db.Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
+	return sqlBuilder.executor().Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
+}
+
+// Upsert 插入，主键或唯一索引冲突时更新；unset 的列不插入也不更新
+func (sqlBuilder *SqlBuilder) Upsert() error {
+	if len(sqlBuilder.Models) != 1 {
+		log.Panic("Upsert option has one table a time!")
+	}
+	var model interface{}
+	for model, sqlBuilder.MainTable = range sqlBuilder.Models {}
+	if err := sqlBuilder.writeErr(); err != nil {
+		return err
+	}
+	parseUpsertSql(sqlBuilder, getModelMeta(reflect.TypeOf(model)).primaryKey)
+	log.Info(sqlBuilder.SqlStmt, sqlBuilder.Values)
+	_, err := sqlBuilder.executor().Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Save 按主键保存，返回 true 表示新建：
+// 主键 unset 或 null 时 INSERT，UUID 的主键生成 v7，整数的主键（auto_increment）写回 LastInsertId；
+// 主键有值时 upsert，影响 1 行为新建，2 行或者没有变化的 0 行为更新（DSN 设置了 clientFoundRows 时无法区分）
+// created_at create_time 为 unset 时写入当前时间，更新时不修改且恢复为 unset；updated_at update_time 总是写入当前时间
+// 写入之前失败时生成的主键和填充的时间戳都恢复，可以直接重试；写入之后的错误（如获取 LastInsertId）不恢复
+func (sqlBuilder *SqlBuilder) Save() (created bool, err error) {
+	if len(sqlBuilder.Models) != 1 {
+		log.Panic("Save option has one table a time!")
+	}
+	var model interface{}
+	for model, sqlBuilder.MainTable = range sqlBuilder.Models {}
+	if sqlBuilder.err != nil {
+		return false, sqlBuilder.err
+	}
+	refValue := reflect.ValueOf(model).Elem()
+	meta := getModelMeta(refValue.Type())
+	if meta.primaryKey == nil {
+		log.Panicf("Save: %s has no primary key!", meta.tableName)
+	}
+	// saved 为生成主键、填充时间戳之前的值，失败时恢复
+	saved := make(map[*fieldMeta]reflect.Value)
+	save := func(field *fieldMeta) {
+		old := reflect.New(field.typ).Elem()
+		old.Set(refValue.FieldByIndex(field.index))
+		saved[field] = old
+	}
+	written := false
+	defer func() {
+		if err != nil && !written {
+			for field, old := range saved {
+				refValue.FieldByIndex(field.index).Set(old)
+			}
+		}
+	}()
+	pk := meta.primaryKey.columnOf(refValue)
+	insert := pk.State() != StateValue
+	autoKey := false
+	if insert {
+		save(meta.primaryKey)
+		if autoKey, err = generateKey(meta, refValue); err != nil {
+			return false, err
+		}
+	}
+	// 时间戳，filled 为填充的 created_at，更新时恢复
+	now := time.Now()
+	var filled []*fieldMeta
+	for _, field := range meta.fields {
+		switch field.column {
+		case "created_at", "create_time", "updated_at", "update_time":
+		default:
+			continue
+		}
+		if v := reflect.New(field.typ).Elem().FieldByName("V"); !field.isColumn() || !v.IsValid() || v.Type() != timeType {
+			continue
+		}
+		column := field.columnOf(refValue)
+		if strings.HasPrefix(field.column, "create") {
+			if column.State() != StateUnset {
+				continue
+			}
+			filled = append(filled, field)
+		}
+		save(field)
+		if err = column.Scan(now); err != nil {
+			return false, err
+		}
+	}
+	_, sqlBuilder.InsertFields, err = dealModel(model)
+	if err != nil {
+		return false, err
+	}
+	if insert {
+		parseInsertSql(sqlBuilder)
+	} else {
+		var insertOnly []string
+		for _, field := range filled {
+			insertOnly = append(insertOnly, field.column)
+		}
+		parseUpsertSql(sqlBuilder, meta.primaryKey, insertOnly...)
+	}
+	log.Info(sqlBuilder.SqlStmt, sqlBuilder.Values)
+	result, err := sqlBuilder.executor().Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
+	if err != nil {
+		return false, err
+	}
+	written = true
+	if autoKey {
+		return true, setInsertId(pk, result)
+	}
+	created = true
+	if !insert {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		created = affected == 1
+	}
+	if !created {
+		for _, field := range filled {
+			refValue.FieldByIndex(field.index).Set(saved[field])
+		}
+	}
+	return created, nil
+}
+
+// generateKey 为 unset 或 null 的主键生成值：UUID 生成 v7；整数的主键（auto_increment）返回 autoKey，插入后由 setInsertId 写回
+func generateKey(meta *modelMeta, refValue reflect.Value) (autoKey bool, err error) {
+	pk := meta.primaryKey.columnOf(refValue)
+	switch v := reflect.New(meta.primaryKey.typ).Elem().FieldByName("V"); {
+	case v.IsValid() && v.Type() == uuidValueType:
+		return false, pk.Scan(UUIDv7())
+	case v.IsValid() && (v.CanInt() || v.CanUint()):
+		return true, nil
+	}
+	return false, fmt.Errorf("mdb: primary key %s.%s is unset and can not be generated", meta.tableName, meta.primaryKey.name)
+}
+
+// setInsertId 自增的主键写回 model
+func setInsertId(pk Column, result sql.Result) error {
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return pk.Scan(id)
+}
 
 func (sqlBuilder *SqlBuilder) Update() error {
+	_, err := sqlBuilder.update()
+	return err
+}
+
+// update 同 Update，返回 sql.Result
+func (sqlBuilder *SqlBuilder) update() (sql.Result, error) {
 	if len(sqlBuilder.Models) != 1 {
 		log.Panic("update option has one table a time!")
 	}
 	var tableName string
 	for _, tableName = range sqlBuilder.Models {}
+	if err := sqlBuilder.writeErr(); err != nil {
+		return nil, err
+	}
 	sqlBuilder.MainTable = tableName
 	parseUpdateSql(sqlBuilder)
-	_, err := db.Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
-	if err != nil {
-		return err
-	}
-	return nil
+	return sqlBuilder.executor().Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
 }
 
 
 func (sqlBuilder *SqlBuilder) Delete() error {
+	_, err := sqlBuilder.delete()
+	return err
+}
+
+// delete 同 Delete，返回 sql.Result
+func (sqlBuilder *SqlBuilder) delete() (sql.Result, error) {
 	if len(sqlBuilder.Models) != 1 {
 		log.Panic("update option has one table a time!")
 	}
 	var tableName string
 	for _, tableName = range sqlBuilder.Models {}
+	if sqlBuilder.err != nil {
+		return nil, sqlBuilder.err
+	}
 	sqlBuilder.MainTable = tableName
 	parseDeleteSql(sqlBuilder)
-	_, err := db.Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
-	if err != nil {
-		return err
-	}
-	return nil
+	return sqlBuilder.executor().Exec(sqlBuilder.SqlStmt, sqlBuilder.Values...)
 }
 
 
@@ -317,12 +399,30 @@ func (sqlBuilder *SqlBuilder) Where(terms ...Term) *SqlBuilder {
 	for _, value := range values{
 		sqlBuilder.Values = append(sqlBuilder.Values, value)
 	}
+	sqlBuilder.condValues = append(sqlBuilder.condValues, values...)
 	sqlBuilder.SqlStmt = fmt.Sprintf("%s where %s", sqlBuilder.SqlStmt, sqlBuilder.whereCons)
 	return sqlBuilder
 }
 
 // Map 将sql返回的row，dest 是一个结构体或者结构体的数组
 func (sqlBuilder *SqlBuilder) Map(dests ...interface{}) error {
+	if sqlBuilder.err != nil {
+		return sqlBuilder.err
+	}
+	if sqlBuilder.cursor != nil {
+		if err := sqlBuilder.prepareCursor(); err != nil {
+			return err
+		}
+	}
+	if len(sqlBuilder.preloads) != 0 {
+		sqlBuilder.preparePreload()
+	}
+	if sqlBuilder.collapse != nil {
+		var err error
+		if dests, err = sqlBuilder.prepareCollapse(dests); err != nil {
+			return err
+		}
+	}
 	// 组装sql 语句
 	parseSelectSql(sqlBuilder)
 	log.Info(sqlBuilder.SqlStmt, sqlBuilder.Values)
@@ -330,6 +430,9 @@ func (sqlBuilder *SqlBuilder) Map(dests ...interface{}) error {
 	if err != nil {
 		return err
 	}
+	if len(sqlBuilder.preloads) != 0 {
+		return sqlBuilder.doPreload(dests...)
+	}
 	return nil
 }
 
@@ -357,6 +460,7 @@ func (sqlBuilder *SqlBuilder) join(mode JoinMode, model interface{}, onTerms ...
 	// 组装On 条件
 	sqlCons, values := assemble(onTerms...)
 	sqlBuilder.Values = values
+	sqlBuilder.condValues = append(sqlBuilder.condValues, values...)
 	aJoinOnCell.On = strings.Join(sqlCons, " ")
 	sqlBuilder.JoinOns = append(sqlBuilder.JoinOns, aJoinOnCell)
 	return sqlBuilder
@@ -372,8 +476,11 @@ func (term Term) translate(_condStr string, _v []interface{},
 	} else {
 		condStr = _condStr + makeOneTerm(term, false)
 	}
-	if term.Value != nil {
-		v = append(_v, term.Value)
+	v = append(_v, term.Args...)
+	if vs, ok := term.Value.([]interface{}); ok && (term.Op == OpIn || term.Op == OpNotIn) {
+		v = append(v, vs...)
+	} else if term.Value != nil {
+		v = append(v, term.Value)
 	}
 	for i, t := range term.CatchTerms {
 		if i == 0 && t.CatchTerms == nil {
@@ -440,6 +547,12 @@ func makeOneTerm(term Term, isEnd bool) (condStr string) {
 		opStr = "in"
 	case OpNotIn:
 		opStr = "not in"
+	case OpExpr:
+		condStr = term.One
+		if !isEnd {
+			condStr += getGroupOpStr(term.GroupOp)
+		}
+		return
 	default:
 		return ""
 	}
@@ -476,7 +589,52 @@ func parseSelectSql(sqlBuilder *SqlBuilder) {
 	if sqlBuilder.whereCons != "" {
 		sqlStmt += " Where " + sqlBuilder.whereCons
 	}
+	values := append([]interface{}(nil), sqlBuilder.condValues...)
+	if sqlBuilder.cursor != nil && len(sqlBuilder.cursor.values) != 0 {
+		cond, cursorValues := sqlBuilder.cursor.keysetCond(sqlBuilder.orderBys)
+		if sqlBuilder.whereCons != "" {
+			sqlStmt += " and " + cond
+		} else {
+			sqlStmt += " Where " + cond
+		}
+		values = append(values, cursorValues...)
+	}
+	if len(sqlBuilder.orderBys) != 0 {
+		orders := make([]string, len(sqlBuilder.orderBys))
+		for i, order := range sqlBuilder.orderBys {
+			orders[i] = order.String()
+			values = append(values, order.args...)
+		}
+		sqlStmt += " ORDER BY " + strings.Join(orders, ", ")
+	}
+	if sqlBuilder.limit > 0 {
+		limit := sqlBuilder.limit
+		if sqlBuilder.cursor != nil {
+			limit++ // 多取一行判断是否有下一页
+		}
+		sqlStmt += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, sqlBuilder.offset)
+	}
 	sqlBuilder.SqlStmt = sqlStmt
+	sqlBuilder.Values = values
+}
+
+// parseCountSql 组装 count 语句，和 select 共用 join where，去掉 order by limit
+func parseCountSql(sqlBuilder *SqlBuilder) string {
+	count := "*"
+	// join has_many 时一条主表记录对应多行，按主键去重
+	if len(sqlBuilder.JoinOns) != 0 {
+		if pk := getModelMeta(sqlBuilder.mainModel().Type()).primaryKey; pk != nil {
+			count = fmt.Sprintf("DISTINCT `%s`.%s", sqlBuilder.MainTable, pk.column)
+		}
+	}
+	sqlStmt := fmt.Sprintf("SELECT COUNT(%s) FROM %s ", count, sqlBuilder.MainTable)
+	for _, joinOn := range sqlBuilder.JoinOns {
+		sqlStmt += fmt.Sprintf("%s On %s ", joinOn.Join, joinOn.On)
+	}
+	if sqlBuilder.whereCons != "" {
+		sqlStmt += " Where " + sqlBuilder.whereCons
+	}
+	return sqlStmt
 }
 
 // parseInsertSql 通过sqlBuilder的元素组装 insert sql 语句
@@ -494,6 +652,29 @@ func parseInsertSql(sqlBuilder *SqlBuilder) {
 	sqlBuilder.SqlStmt = sqlStmt
 }
 
+// parseUpsertSql insert ... on duplicate key update，主键和 insertOnly 的列不更新
+func parseUpsertSql(sqlBuilder *SqlBuilder, primaryKey *fieldMeta, insertOnly ...string) {
+	parseInsertSql(sqlBuilder)
+	skip := make(map[string]bool)
+	if primaryKey != nil {
+		skip[primaryKey.column] = true
+	}
+	for _, column := range insertOnly {
+		skip[column] = true
+	}
+	var updates []string
+	for _, field := range sqlBuilder.InsertFields {
+		if skip[field.columnName] {
+			continue
+		}
+		updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", field.columnName, field.columnName))
+	}
+	if len(updates) == 0 && primaryKey != nil { // 只有主键，冲突时什么也不做
+		updates = append(updates, fmt.Sprintf("%s=%s", primaryKey.column, primaryKey.column))
+	}
+	sqlBuilder.SqlStmt += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+}
+
 func parseUpdateSql(sqlBuilder *SqlBuilder) {
 	signs := make([]string, len(sqlBuilder.InsertFields))
 	insertValues := make([]interface{}, len(sqlBuilder.InsertFields))
@@ -1,10 +1,17 @@
 package mdb
 
 import (
+	"database/sql/driver"
+	"errors"
+	"encoding/hex"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -137,6 +144,64 @@ func TestSqlInsert(t *testing.T)  {
 
 }
 
+func TestUpsertSql(t *testing.T)  {
+	stu := &Student{
+		ID:    NewVarchar("113"),
+		Name:  Null[Varchar](),
+		State: NewBool(false),
+	}
+	sqlBuilder := Model(stu)
+	sqlBuilder.MainTable = "student"
+	parseUpsertSql(sqlBuilder, getModelMeta(reflect.TypeOf(stu)).primaryKey)
+	// ClassId Score CreateTime 没有赋值，不插入也不更新
+	expect := "INSERT INTO student(id,name,state) VALUES(?,?,?) ON DUPLICATE KEY UPDATE name=VALUES(name),state=VALUES(state)"
+	if sqlBuilder.SqlStmt != expect {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	if !reflect.DeepEqual(sqlBuilder.Values, []interface{}{"113", nil, false}) {
+		t.Fatalf("got %v", sqlBuilder.Values)
+	}
+	sqlBuilder = Model(&Student{ID: NewVarchar("113")})
+	sqlBuilder.MainTable = "student"
+	parseUpsertSql(sqlBuilder, getModelMeta(reflect.TypeOf(stu)).primaryKey)
+	if sqlBuilder.SqlStmt != "INSERT INTO student(id) VALUES(?) ON DUPLICATE KEY UPDATE id=id" {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+}
+
+func TestSqlUpsert(t *testing.T)  {
+	err := Model(&Student{
+		ID:      NewVarchar("112"),
+		ClassId: NewVarchar("222"),
+		Score:   Null[Decimal](),
+		State:   NewBool(false),
+	}).Upsert()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSqlJSON(t *testing.T)  {
+	err := Model(&Profile{
+		ID:       NewVarchar("1"),
+		Settings: NewJSON(ProfileSettings{Theme: "dark", Tags: []string{"vip"}}),
+	}).Upsert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := &Profile{}
+	var profiles []Profile
+	err = Model(profile).Select(profile.ID, profile.Settings).
+		Where(profile.Settings.Path("$.theme").Eq("dark"), profile.Settings.JSONContains("vip", "$.tags")).
+		Map(&profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].Settings.V.Theme != "dark" {
+		t.Fatalf("got %+v", profiles)
+	}
+}
+
 func TestSqlUpdate(t *testing.T)  {
 	aa := &School{
 		Title: Varchar{V: "辽宁工程技术大学12334567"},
@@ -159,3 +224,661 @@ func TestSqlDelete(t *testing.T)  {
 	}
 
 }
+
+func TestSqlPaginate(t *testing.T)  {
+	stu := &Student{}
+	var stus []Student
+	total, err := Model(stu).Select(stu.ID, stu.Name).Where(stu.State.Eq(1)).
+		OrderBy(stu.CreateTime.Desc(), stu.ID).Paginate(1, 10, &stus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(total, len(stus))
+	// 游标分页，一直取到最后一页
+	var cursor string
+	for {
+		stus = []Student{}
+		stu = &Student{}
+		sqlBuilder := Model(stu).Select(stu.ID, stu.Name).
+			OrderBy(stu.CreateTime.Desc(), stu.ID).After(cursor, 2)
+		if err = sqlBuilder.Map(&stus); err != nil {
+			t.Fatal(err)
+		}
+		if cursor = sqlBuilder.Cursor(); cursor == "" {
+			break
+		}
+	}
+}
+
+// TestCursorBytes binary 的排序列不是合法的 utf8，解码后不变
+func TestCursorBytes(t *testing.T)  {
+	digest := []byte{0xff, 0xfe, 0x00, 'a'}
+	cursor, err := encodeCursor([]string{"file.digest"}, []interface{}{digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, values, err := decodeCursor(cursor)
+	if err != nil || !reflect.DeepEqual(values, []interface{}{digest}) {
+		t.Errorf("values = %v, err = %v, want %v", values, err, digest)
+	}
+}
+
+func TestPageCursor(t *testing.T)  {
+	createTime := time.Date(2021, 5, 1, 8, 30, 0, 0, time.UTC)
+	cursor, err := encodeCursor([]string{"student.create_time", "student.id"},
+		[]interface{}{createTime, "112"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stu := &Student{}
+	var stus []Student
+	sqlBuilder := Model(stu).Select(stu.Name).OrderBy(stu.CreateTime.Desc(), stu.ID).After(cursor, 2)
+	if err = sqlBuilder.prepareCursor(); err != nil {
+		t.Fatal(err)
+	}
+	parseSelectSql(sqlBuilder)
+	want := "SELECT student.name As student_name, student.create_time As student_create_time, " +
+		"student.id As student_id FROM student  Where ((`student`.create_time < ?) or " +
+		"(`student`.create_time = ? and `student`.id > ?)) ORDER BY `student`.create_time DESC, " +
+		"`student`.id ASC LIMIT 3 OFFSET 0"
+	if sqlBuilder.SqlStmt != want {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	if len(sqlBuilder.Values) != 3 || sqlBuilder.Values[0] != "2021-05-01 08:30:00" || sqlBuilder.Values[2] != "112" {
+		t.Fatalf("got values %v", sqlBuilder.Values)
+	}
+	// 游标和 OrderBy 不一致
+	err = Model(stu).Select(stu.Name).OrderBy(stu.ID).After(cursor, 2).Map(&stus)
+	if err != ErrInvalidCursor {
+		t.Fatalf("expect ErrInvalidCursor, got %v", err)
+	}
+	if err = Model(stu).Select(stu.Name).After("not-a-cursor", 2).Map(&stus); err != ErrInvalidCursor {
+		t.Fatalf("expect ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestPageCursorNext(t *testing.T)  {
+	l := useFakeDb(t)
+	now := time.Now()
+	rowCount := 2
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		var rows [][]driver.Value
+		for i := 0; i < rowCount; i++ {
+			rows = append(rows, []driver.Value{[]byte(strconv.Itoa(i)), []byte("a"), now})
+		}
+		return []string{"id", "name", "create_time"}, rows
+	}
+	page := func() (*SqlBuilder, []Student) {
+		stu := &Student{}
+		var stus []Student
+		sqlBuilder := Model(stu).Select(stu.ID, stu.Name).OrderBy(stu.CreateTime.Desc(), stu.ID).After("", 2)
+		if err := sqlBuilder.Map(&stus); err != nil {
+			t.Fatal(err)
+		}
+		return sqlBuilder, stus
+	}
+	// 正好一页时没有下一页
+	if sqlBuilder, stus := page(); len(stus) != 2 || sqlBuilder.Cursor() != "" {
+		t.Errorf("got %d rows, cursor %q, want no next page", len(stus), sqlBuilder.Cursor())
+	}
+	// 多取到的一行不返回
+	rowCount = 3
+	sqlBuilder, stus := page()
+	if len(stus) != 2 || sqlBuilder.Cursor() == "" {
+		t.Fatalf("got %d rows, cursor %q, want next page", len(stus), sqlBuilder.Cursor())
+	}
+	_, values, _ := decodeCursor(sqlBuilder.Cursor())
+	if values[1] != "1" {
+		t.Errorf("cursor values = %v, should come from the last returned row", values)
+	}
+
+	// 重复组装 sql 参数不累加
+	stu := &Student{}
+	sqlBuilder = Model(stu).Select(stu.ID).Where(stu.State.Eq(1)).OrderBy(stu.ID).After(sqlBuilder.Cursor(), 2)
+	parseSelectSql(sqlBuilder)
+	parseSelectSql(sqlBuilder)
+	if len(sqlBuilder.Values) != 2 {
+		t.Errorf("got values %v", sqlBuilder.Values)
+	}
+}
+
+func TestPaginateCountDistinct(t *testing.T)  {
+	l := useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"count"}, [][]driver.Value{{int64(0)}}
+	}
+	class, stu := &Class{}, &Student{}
+	var classes []Class
+	total, err := Model(class, stu).Select(class.ID, stu.ID).LeftJoin(stu, stu.ClassId.Eq(class.ID)).
+		Paginate(1, 10, &classes)
+	if err != nil || total != 0 {
+		t.Fatalf("total = %d, err = %v", total, err)
+	}
+	assertStmts(t, l, "SELECT COUNT(DISTINCT `class`.id) FROM class  LEFT JOIN student")
+}
+
+// TestPaginateJoined join has_many 时按主表主键分页，同一个 class 的学生不会分到两页
+func TestPaginateJoined(t *testing.T)  {
+	l := useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		switch {
+		case strings.HasPrefix(stmt, "SELECT COUNT"):
+			return []string{"count"}, [][]driver.Value{{int64(3)}}
+		case strings.HasPrefix(stmt, "SELECT `class`.id"):
+			return []string{"id"}, [][]driver.Value{{[]byte("c1")}, {[]byte("c2")}}
+		}
+		return []string{"class_id", "student_id"},
+			[][]driver.Value{{[]byte("c1"), []byte("s1")}, {[]byte("c1"), []byte("s2")}, {[]byte("c2"), []byte("s3")}}
+	}
+	class, stu := &Class{}, &Student{}
+	var classes []Class
+	total, err := Model(class, stu).Select(class.ID, stu.ID).LeftJoin(stu, stu.ClassId.Eq(class.ID)).
+		Where(class.SchoolId.Eq("s1")).OrderBy(class.ID.Desc()).Collapse("Students").Paginate(1, 2, &classes)
+	if err != nil || total != 3 {
+		t.Fatalf("total = %d, err = %v", total, err)
+	}
+	assertStmts(t, l, "SELECT COUNT(DISTINCT `class`.id)",
+		"SELECT `class`.id FROM class  LEFT JOIN student  On `student`.class_id = `class`.id  Where `class`.school_id = ? "+
+			"GROUP BY `class`.id ORDER BY `class`.id DESC LIMIT 2 OFFSET 0",
+		"SELECT class.id As class_id, student.id As student_id FROM class  LEFT JOIN student  On `student`.class_id = `class`.id "+
+			" Where (`class`.school_id = ?) and `class`.id in (?,?) ORDER BY `class`.id DESC")
+	if len(classes) != 2 || len(classes[0].Students) != 2 || len(classes[1].Students) != 1 {
+		t.Errorf("classes = %+v, want 2 classes with all their students", classes)
+	}
+
+	// 按子表的列排序无法按主表分页
+	_, err = Model(class, stu).Select(class.ID, stu.ID).LeftJoin(stu, stu.ClassId.Eq(class.ID)).
+		OrderBy(stu.Name.Asc()).Paginate(1, 2, &classes)
+	if err == nil {
+		t.Error("ordering by a joined column should fail")
+	}
+}
+
+func TestSqlPreload(t *testing.T)  {
+	stu := &Student{}
+	var stus []Student
+	err := Model(stu).Select(stu.ID, stu.Name).Preload("Class.School", "Class.Students").Map(&stus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range stus {
+		if v.Class == nil {
+			continue
+		}
+		t.Log(v.Name.V, v.Class.Number.V, v.Class.School.Title.V, len(v.Class.Students))
+	}
+}
+
+type shelf struct {
+	ID    Binary `mdb:"length:16 primary key"`
+	Items []item `mdb:"has_many:shelf_id"`
+}
+
+type item struct {
+	ID      Varchar `mdb:"length:45 primary key"`
+	ShelfId Binary  `mdb:"length:16"`
+	BoxId   Int
+	Box     box `mdb:"belongs_to:box_id"`
+}
+
+type box struct {
+	ID   Bigint `mdb:"primary key"`
+	Name Varchar
+}
+
+// TestPreloadKeys binary 的主键作为 map key，Int 的外键对应 Bigint 的主键
+func TestPreloadKeys(t *testing.T)  {
+	l := useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(stmt, "FROM shelf"):
+			return []string{"id"}, [][]driver.Value{{[]byte{0xff, 1}}, {[]byte{0xff, 2}}}
+		case strings.Contains(stmt, "FROM item"):
+			return []string{"id", "shelf_id", "box_id"},
+				[][]driver.Value{{[]byte("a"), []byte{0xff, 1}, int64(7)}, {[]byte("b"), []byte{0xff, 1}, int64(7)}}
+		}
+		return []string{"id", "name"}, [][]driver.Value{{int64(7), []byte("big")}}
+	}
+	var shelves []shelf
+	s := &shelf{}
+	if err := Model(s).Select(s.ID).Preload("Items.Box").Map(&shelves); err != nil {
+		t.Fatal(err)
+	}
+	if len(shelves) != 2 || len(shelves[0].Items) != 2 || len(shelves[1].Items) != 0 {
+		t.Fatalf("shelves = %+v", shelves)
+	}
+	if shelves[0].Items[1].Box.Name.V != "big" {
+		t.Errorf("box = %+v, Int foreign key should match Bigint primary key", shelves[0].Items[1].Box)
+	}
+}
+
+func TestTermIn(t *testing.T)  {
+	stu := &Student{}
+	sqlBuilder := Model(stu).Select(stu.ID).Where(stu.ID.In("1", "2", "3"), stu.State.Eq(1))
+	parseSelectSql(sqlBuilder)
+	want := "SELECT student.id As student_id FROM student  Where `student`.id in (?,?,?) and  `student`.state = ?"
+	if sqlBuilder.SqlStmt != want {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	if len(sqlBuilder.Values) != 4 {
+		t.Fatalf("got values %v", sqlBuilder.Values)
+	}
+}
+
+func TestJSONPath(t *testing.T)  {
+	profile := &Profile{}
+	sqlBuilder := Model(profile).Select(profile.ID).Where(
+		profile.Settings.Path("$.theme").Eq("dark"),
+		profile.Settings.JSONContains("vip", "$.tags"),
+		profile.Settings.Path("$.tags").Contains([]string{"a", "b"}),
+	)
+	parseSelectSql(sqlBuilder)
+	want := "SELECT profile.id As profile_id FROM profile  Where JSON_EXTRACT(`profile`.settings, ?) = ? and  " +
+		"JSON_CONTAINS(`profile`.settings, ?, ?) and  JSON_CONTAINS(`profile`.settings, ?, ?)"
+	if sqlBuilder.SqlStmt != want {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	values := []interface{}{"$.theme", "dark", `"vip"`, "$.tags", `["a","b"]`, "$.tags"}
+	if !reflect.DeepEqual(sqlBuilder.Values, values) {
+		t.Fatalf("got values %v", sqlBuilder.Values)
+	}
+	// insert 时 json 序列化
+	sqlBuilder = Model(&Profile{ID: NewVarchar("1"), Settings: NewJSON(ProfileSettings{Theme: "dark"})})
+	if value := sqlBuilder.InsertFields[1].value; value != `{"theme":"dark","tags":null}` {
+		t.Fatalf("got %v", value)
+	}
+}
+
+type metric struct {
+	ID    Varchar `mdb:"length:45 primary key"`
+	Value JSON[float64]
+}
+
+// TestJSONValueErr Valuer 的错误只影响写入，model 只用于查询时忽略
+func TestJSONValueErr(t *testing.T)  {
+	l := useFakeDb(t)
+	m := &metric{ID: NewVarchar("1"), Value: NewJSON(math.NaN())}
+	var metrics []metric
+	if err := Model(m).Select(m.ID).Where(m.ID.Eq("1")).Map(&metrics); err != nil {
+		t.Fatalf("select should ignore value error, got %v", err)
+	}
+	if err := Model(m).Insert(); err == nil {
+		t.Error("insert should return the marshal error")
+	}
+	if err := Model(m).Where(m.ID.Eq("1")).Update(); err == nil {
+		t.Error("update should return the marshal error")
+	}
+	assertStmts(t, l, "SELECT")
+}
+
+func TestEnumSet(t *testing.T)  {
+	profile := &Profile{}
+	sqlBuilder := Model(profile).Select(profile.ID).Where(profile.Roles.FindInSet("admin"), profile.Status.Eq("active"))
+	parseSelectSql(sqlBuilder)
+	want := "SELECT profile.id As profile_id FROM profile  Where FIND_IN_SET(?, `profile`.roles) and  `profile`.status = ?"
+	if sqlBuilder.SqlStmt != want {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	sqlBuilder = Model(&Profile{ID: NewVarchar("1"), Status: NewEnum("disabled"), Roles: NewSet("read", "admin")})
+	if sqlBuilder.err != nil || sqlBuilder.InsertFields[2].value != "read,admin" {
+		t.Fatalf("got %v %v", sqlBuilder.InsertFields, sqlBuilder.err)
+	}
+	// 写入前校验，不会执行 sql
+	if err := Model(&Profile{ID: NewVarchar("1"), Status: NewEnum("deleted")}).Insert(); err == nil {
+		t.Fatal("enum value deleted should be rejected")
+	}
+	if err := Model(&Profile{ID: NewVarchar("1"), Roles: NewSet("read", "root")}).Update(); err == nil {
+		t.Fatal("set value root should be rejected")
+	}
+	// 空集合和 null 都是允许的
+	if sqlBuilder = Model(&Profile{Roles: NewSet(), Status: Null[Enum]()}); sqlBuilder.err != nil {
+		t.Fatal(sqlBuilder.err)
+	}
+}
+
+func TestGeoSql(t *testing.T)  {
+	store := &Store{}
+	sqlBuilder := Model(store).Select(store.ID, store.Location).Where(store.Location.WithinDistance(41.8, 123.4, 500)).
+		OrderByDistance(store.Location, 41.8, 123.4).OrderBy(store.ID)
+	parseSelectSql(sqlBuilder)
+	want := "SELECT store.id As store_id, store.location As store_location FROM store  Where " +
+		"ST_Distance_Sphere(`store`.location, ST_SRID(POINT(?, ?), 4326)) <= ? ORDER BY " +
+		"ST_Distance_Sphere(`store`.location, ST_SRID(POINT(?, ?), 4326)) ASC, `store`.id ASC"
+	if sqlBuilder.SqlStmt != want {
+		t.Fatalf("got %s", sqlBuilder.SqlStmt)
+	}
+	if !reflect.DeepEqual(sqlBuilder.Values, []interface{}{123.4, 41.8, 500.0, 123.4, 41.8}) {
+		t.Fatalf("got values %v", sqlBuilder.Values)
+	}
+	if err := Model(store).Select(store.ID).OrderByDistance(store.Location, 0, 0).After("", 10).Map(&[]Store{}); err == nil {
+		t.Fatal("After should reject distance order")
+	}
+}
+
+func TestSqlGeo(t *testing.T)  {
+	err := Model(&Store{ID: NewVarchar("1"), Name: NewVarchar("中街"), Location: NewPoint(41.7963, 123.4508)}).Upsert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Store{}
+	var stores []Store
+	err = Model(store).Select(store.ID, store.Location).Where(store.Location.WithinDistance(41.8, 123.45, 1000)).
+		OrderByDistance(store.Location, 41.8, 123.45).Map(&stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stores) == 0 || stores[0].Location.V.Lat != 41.7963 {
+		t.Fatalf("got %+v", stores)
+	}
+}
+
+func TestUUIDTerm(t *testing.T)  {
+	id := "0189e4a5-6b1c-7cc2-9f1e-3c2a5d8e7f10"
+	u, _ := ParseUUID(id)
+	device := &Device{}
+	sqlBuilder := Model(device).Select(device.ID).
+		Where(device.ID.Eq(id), device.Serial.In("6ccd780c-baba-1026-9564-5b8c656024db", "bad"))
+	parseSelectSql(sqlBuilder)
+	serial, _ := hex.DecodeString("1026baba6ccd780c95645b8c656024db")
+	values := []interface{}{u[:], serial, "bad"}
+	if !reflect.DeepEqual(sqlBuilder.Values, values) {
+		t.Fatalf("got values %v", sqlBuilder.Values)
+	}
+	sqlBuilder = Model(&Device{ID: NewUUID(u), Serial: NewOrderedUUID(u)})
+	if !reflect.DeepEqual(sqlBuilder.InsertFields[0].value, u[:]) {
+		t.Fatalf("got %v", sqlBuilder.InsertFields[0].value)
+	}
+}
+
+func TestSqlUUID(t *testing.T)  {
+	u := UUIDv7()
+	if err := Model(&Device{ID: NewUUID(u), Serial: NewOrderedUUID(u), Name: NewVarchar("pos")}).Insert(); err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{}
+	var devices []Device
+	err := Model(device).Select(device.ID, device.Serial).Where(device.ID.Eq(u.String())).Map(&devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID.V != u || devices[0].Serial.V != u {
+		t.Fatalf("got %+v", devices)
+	}
+}
+
+func TestSqlAssociation(t *testing.T)  {
+	courses := []Course{{ID: Varchar{V: "c1"}, Title: Varchar{V: "数学"}}, {ID: Varchar{V: "c2"}, Title: Varchar{V: "语文"}}}
+	for i := range courses {
+		if err := Model(&courses[i]).Insert(); err != nil {
+			t.Log(err)
+		}
+	}
+	stu := &Student{ID: Varchar{V: "112"}}
+	if err := Model(stu).Association("Courses").Replace(&courses[0], &courses[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Model(stu).Association("Courses").Remove(courses[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(stu.Courses) != 1 {
+		t.Fatalf("expect 1 course, got %d", len(stu.Courses))
+	}
+	stu = &Student{}
+	var stus []Student
+	err := Model(stu).Select(stu.ID, stu.Name).Where(stu.ID.Eq("112")).Preload("Courses").Map(&stus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range stus {
+		t.Log(v.Name.V, len(v.Courses))
+	}
+}
+
+func TestSqlCollapse(t *testing.T)  {
+	var classes []Class
+	var stus []Student
+	class := &Class{}
+	stu := &Student{}
+	err := Model(class, stu).Select(class.ID, class.Number, stu.ID, stu.Name).
+		LeftJoin(stu, stu.ClassId.Eq(class.ID)).
+		Collapse("Students").Map(&classes, &stus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, v := range classes {
+		if ids[v.ID.V] {
+			t.Fatalf("class %s duplicated", v.ID.V)
+		}
+		ids[v.ID.V] = true
+		t.Log(v.Number.V, len(v.Students))
+	}
+}
+
+func TestCollapseDest(t *testing.T)  {
+	class := &Class{}
+	stu := &Student{}
+	var classes []Class
+	// 不是结构体数组的指针，和 Map 一样返回错误而不是 panic
+	for _, dest := range []interface{}{classes, class, (*[]Class)(nil)} {
+		err := Model(class, stu).Select(class.ID, stu.ID).LeftJoin(stu, stu.ClassId.Eq(class.ID)).
+			Collapse("Students").Map(dest)
+		if err == nil {
+			t.Errorf("Map(%T) should fail", dest)
+		}
+	}
+}
+
+// TestCollapseBinaryKey binary 的主键去重
+func TestCollapseBinaryKey(t *testing.T)  {
+	l := useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"shelf_id", "item_id"},
+			[][]driver.Value{{[]byte{0xff, 1}, []byte("a")}, {[]byte{0xff, 1}, []byte("b")}, {[]byte{0xff, 2}, nil}}
+	}
+	s, it := &shelf{}, &item{}
+	var shelves []shelf
+	var items []item
+	err := Model(s, it).Select(s.ID, it.ID).LeftJoin(it, it.ShelfId.Eq(s.ID)).Collapse("Items").Map(&shelves, &items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shelves) != 2 || len(shelves[0].Items) != 2 || len(items) != 2 {
+		t.Fatalf("shelves = %+v, items = %+v", shelves, items)
+	}
+}
+
+type post struct {
+	ID   Varchar `mdb:"length:45 primary key"`
+	Tags []tag   `mdb:"many_to_many:post_tag"`
+}
+
+type tag struct {
+	ID Binary `mdb:"length:16 primary key"`
+}
+
+// TestAssociationBinaryKey binary 的主键去重和删除
+func TestAssociationBinaryKey(t *testing.T)  {
+	l := useFakeDb(t)
+	p := &post{ID: NewVarchar("p1")}
+	first, second := NewBinary([]byte{0xff, 1}), NewBinary([]byte{0xff, 2})
+	if err := Model(p).Association("Tags").Append(&tag{ID: first}, tag{ID: first}, tag{ID: second}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tags) != 2 {
+		t.Fatalf("tags = %+v, want 2", p.Tags)
+	}
+	if err := Model(p).Association("Tags").Remove(tag{ID: first}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tags) != 1 || p.Tags[0].ID.V[1] != 2 {
+		t.Errorf("tags = %+v, want the second", p.Tags)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "COMMIT", "BEGIN", "DELETE FROM post_tag", "COMMIT")
+}
+
+// BenchmarkMap 不连接数据库，只统计组装 sql 和定位 scan 地址的开销
+func BenchmarkMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stu := &Student{}
+		var stus []Student
+		sqlBuilder := Model(stu).Select(stu.ID, stu.Name, stu.ClassId, stu.Score, stu.CreateTime, stu.State).
+			Where(stu.State.Eq(1))
+		parseSelectSql(sqlBuilder)
+		err, destCatch := checkDest(sqlBuilder.SelectFields, &stus)
+		if err != nil {
+			b.Fatal(err)
+		}
+		values := make([]interface{}, len(sqlBuilder.SelectFields))
+		for row := 0; row < 20; row++ {
+			locateScanValues(destCatch, values, sqlBuilder.SelectFields)
+		}
+	}
+}
+
+// BenchmarkInsert 不连接数据库，只统计组装 insert 语句的开销
+func BenchmarkInsert(b *testing.B) {
+	b.ReportAllocs()
+	now := time.Now()
+	for i := 0; i < b.N; i++ {
+		sqlBuilder := Model(&Student{
+			ID:         Varchar{V: "112"},
+			ClassId:    Varchar{V: "222"},
+			Name:       Varchar{V: "振兴"},
+			Score:      Decimal{V: decimal.NewFromFloat(3.1415926)},
+			CreateTime: Datetime{V: now},
+			State:      Bool{V: false, NotNul: true},
+		})
+		for _, sqlBuilder.MainTable = range sqlBuilder.Models {}
+		parseInsertSql(sqlBuilder)
+	}
+}
+
+// TestInsertValues Int 和 NotNul 的零值 Datetime 也要写入
+func TestInsertValues(t *testing.T)  {
+	sqlBuilder := Model(&TestModelB{
+		OwnerID:     Varchar{V: "1"},
+		DbInteger1:  Int{V: 0, NotNul: true},
+		DbBigint1:   Bigint{V: 7},
+		CreatedTime: Datetime{NotNul: true},
+	})
+	got := make(map[string]interface{})
+	for _, field := range sqlBuilder.InsertFields {
+		got[field.columnName] = field.value
+	}
+	if len(got) != 4 || got["db_integer1"] != int64(0) || got["db_bigint1"] != int64(7) ||
+		got["created_time"] != (time.Time{}) {
+		t.Errorf("insert values = %v", got)
+	}
+}
+
+// TestInsertTime Time 通过 Valuer 写入 HH:MM:SS，而不是纳秒数
+func TestInsertTime(t *testing.T)  {
+	sqlBuilder := Model(&typesModel{ID: NewBigint(1), Start: NewTime(-(8*time.Hour + 30*time.Minute))})
+	for _, sqlBuilder.MainTable = range sqlBuilder.Models {}
+	parseInsertSql(sqlBuilder)
+	if sqlBuilder.SqlStmt != "INSERT INTO types_model(id,start) VALUES(?,?)" || sqlBuilder.Values[1] != "-08:30:00" {
+		t.Errorf("got %s %v", sqlBuilder.SqlStmt, sqlBuilder.Values)
+	}
+}
+
+func TestModelMeta(t *testing.T)  {
+	metas := make(chan *modelMeta, 8)
+	for i := 0; i < cap(metas); i++ {
+		go func() {
+			metas <- getModelMeta(reflect.TypeOf(&Student{}))
+		}()
+	}
+	first := <-metas
+	for i := 1; i < cap(metas); i++ {
+		if meta := <-metas; meta != first {
+			t.Fatal("model meta should be parsed once")
+		}
+	}
+	if first.tableName != "student" || first.primaryKey.column != "id" {
+		t.Fatalf("got table %s primary key %s", first.tableName, first.primaryKey.column)
+	}
+	if _, ok := first.byColumn["class_id"]; !ok {
+		t.Fatal("class_id column not found")
+	}
+	if _, ok := first.relations["Courses"]; !ok {
+		t.Fatal("Courses relation not found")
+	}
+}
+
+func TestSqlSave(t *testing.T) {
+	l := useFakeDb(t)
+	l.result = func(stmt string) driver.Result { return savedResult{id: 42, affected: 1} }
+	// 自增主键：INSERT 后写回 id，填充时间
+	comment := &Comment{StudentId: NewVarchar("1"), Content: NewText("hi")}
+	created, err := Model(comment).Save()
+	if err != nil || !created {
+		t.Fatalf("created = %v, err = %v", created, err)
+	}
+	assertStmts(t, l, "INSERT INTO comment(student_id,content,created_at,updated_at) VALUES(?,?,?,?)")
+	if comment.ID.V != 42 || comment.CreatedAt.V.IsZero() || comment.UpdatedAt.V.IsZero() {
+		t.Errorf("comment = %+v, should populate id and timestamps", comment)
+	}
+
+	// 有主键时 upsert，created_at 不更新；影响 2 行为更新
+	l.stmts = nil
+	l.result = func(stmt string) driver.Result { return savedResult{affected: 2} }
+	comment = &Comment{ID: NewBigint(42), Content: NewText("edited")}
+	if created, err = Model(comment).Save(); err != nil || created {
+		t.Fatalf("created = %v, err = %v", created, err)
+	}
+	assertStmts(t, l, "INSERT INTO comment(id,content,created_at,updated_at) VALUES(?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE content=VALUES(content),updated_at=VALUES(updated_at)")
+	if comment.CreatedAt.State() != StateUnset || comment.UpdatedAt.V.IsZero() {
+		t.Errorf("comment = %+v, created_at should stay unset after update", comment)
+	}
+
+	// uuid 主键生成 v7
+	l.stmts = nil
+	device := &Device{Name: NewVarchar("pos")}
+	if created, err = Model(device).Save(); err != nil || !created {
+		t.Fatalf("created = %v, err = %v", created, err)
+	}
+	assertStmts(t, l, "INSERT INTO device(id,name) VALUES(?,?)")
+	if device.ID.V[6]>>4 != 7 {
+		t.Errorf("device id = %s, want v7", device.ID.V)
+	}
+
+	// 字符串主键无法生成
+	if _, err = Model(&Student{Name: NewVarchar("Tom")}).Save(); err == nil {
+		t.Error("unset varchar primary key should fail")
+	}
+
+	// 失败时恢复生成的主键和时间戳
+	l.fail = func(stmt string) error { return errors.New("lock wait timeout") }
+	device = &Device{Name: NewVarchar("pos")}
+	comment = &Comment{Content: NewText("retry")}
+	if _, err = Model(device).Save(); err == nil || device.ID.State() != StateUnset {
+		t.Errorf("device id = %v, err = %v, id should be unset after failure", device.ID.V, err)
+	}
+	if _, err = Model(comment).Save(); err == nil {
+		t.Fatal("save should fail")
+	}
+	if comment.ID.State() != StateUnset || comment.CreatedAt.State() != StateUnset || comment.UpdatedAt.State() != StateUnset {
+		t.Errorf("comment = %+v, id and timestamps should be unset after failure", comment)
+	}
+
+	// 已经写入后获取 id 失败，时间戳保留
+	l.fail = nil
+	l.result = func(stmt string) driver.Result { return savedResult{affected: 1, idErr: errors.New("no insert id")} }
+	if created, err = Model(comment).Save(); err == nil || !created {
+		t.Fatalf("created = %v, err = %v", created, err)
+	}
+	if comment.CreatedAt.State() != StateValue || comment.UpdatedAt.State() != StateValue {
+		t.Errorf("comment = %+v, timestamps should be kept after the row is written", comment)
+	}
+}
+
+type savedResult struct {
+	id, affected int64
+	idErr        error
+}
+
+func (r savedResult) LastInsertId() (int64, error) { return r.id, r.idErr }
+func (r savedResult) RowsAffected() (int64, error) { return r.affected, nil }
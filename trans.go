@@ -0,0 +1,308 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TransStatusStore 微事务的状态存储；参与的服务等待状态，协调的服务通过 PublishTransResult 写入 Success/Fail
+type TransStatusStore interface {
+	// GetStatus 没有写入过时返回 Pending
+	GetStatus(transId string) (int8, error)
+	SetStatus(transId string, status int8) error
+}
+
+// TransStatusSubscriber 可选，store 实现时等待推送，不再每 50ms 读取一次
+// 返回的 channel 在 ctx 结束或者连接断开时关闭，关闭后回退为轮询
+type TransStatusSubscriber interface {
+	Subscribe(ctx context.Context, transId string) (<-chan int8, error)
+}
+
+var (
+	transStoreMu sync.RWMutex
+	transStore   TransStatusStore = NewMemoryTransStore()
+)
+
+// SetTransStatusStore 设置微事务的状态存储，默认为进程内的 MemoryTransStore
+// 多个服务之间需要使用共享的存储，比如 RedisTransStore
+func SetTransStatusStore(store TransStatusStore) {
+	if store == nil {
+		log.Panic("SetTransStatusStore: store is nil!")
+	}
+	transStoreMu.Lock()
+	defer transStoreMu.Unlock()
+	transStore = store
+}
+
+func getTransStore() TransStatusStore {
+	transStoreMu.RLock()
+	defer transStoreMu.RUnlock()
+	return transStore
+}
+
+// PublishTransResult 协调的服务写入微事务的最终结果，等待该 TransId 的事务随之提交或回滚
+func PublishTransResult(transId string, status int8) error {
+	if status != Success && status != Fail {
+		return fmt.Errorf("mdb: trans %s status should be Success or Fail, not %d", transId, status)
+	}
+	return getTransStore().SetStatus(transId, status)
+}
+
+// awaitTransResult 等待微事务的最终结果，ctx 结束时返回 ctx 的错误
+func awaitTransResult(ctx context.Context, transId string) (int8, error) {
+	store := getTransStore()
+	var updates <-chan int8
+	if sub, ok := store.(TransStatusSubscriber); ok {
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var err error
+		// 先订阅再读取，避免错过订阅之前写入的结果
+		if updates, err = sub.Subscribe(subCtx, transId); err != nil {
+			log.Warningf("subscribe trans %s failed, polling instead, err:%v\n", transId, err)
+		}
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		status, err := store.GetStatus(transId)
+		if err != nil {
+			log.Warningf("get trans %s status failed, err:%v\n", transId, err)
+		} else if status != Pending {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Pending, ctx.Err()
+		case status, ok := <-updates:
+			if !ok {
+				updates = nil // 订阅断开，之后轮询
+				ticker.Reset(50 * time.Millisecond)
+			} else if status != Pending {
+				return status, nil
+			}
+		case <-ticker.C:
+			if updates != nil {
+				ticker.Reset(time.Second) // 订阅时轮询只是兜底
+			}
+		}
+	}
+}
+
+// MemoryTransStore 进程内的状态存储，用于测试或者单进程；状态不会过期
+type MemoryTransStore struct {
+	mu       sync.Mutex
+	statuses map[string]int8
+	subs     map[string][]chan int8
+}
+
+func NewMemoryTransStore() *MemoryTransStore {
+	return &MemoryTransStore{statuses: map[string]int8{}, subs: map[string][]chan int8{}}
+}
+
+func (store *MemoryTransStore) GetStatus(transId string) (int8, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.statuses[transId], nil
+}
+
+func (store *MemoryTransStore) SetStatus(transId string, status int8) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.statuses[transId] = status
+	for _, ch := range store.subs[transId] {
+		select {
+		case ch <- status:
+		default: // 未读取的旧状态不重要，GetStatus 总能读到最新的
+		}
+	}
+	return nil
+}
+
+func (store *MemoryTransStore) Subscribe(ctx context.Context, transId string) (<-chan int8, error) {
+	ch := make(chan int8, 1)
+	store.mu.Lock()
+	store.subs[transId] = append(store.subs[transId], ch)
+	store.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		subs := store.subs[transId]
+		for i, sub := range subs {
+			if sub == ch {
+				subs = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(subs) == 0 {
+			delete(store.subs, transId)
+		} else {
+			store.subs[transId] = subs
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// TransOutcome 事务最终的结果
+type TransOutcome int8
+
+const (
+	TransCommit TransOutcome = iota + 1
+	TransRollback
+	TransTimeout // 等待微事务结果超时，已回滚
+)
+
+func (outcome TransOutcome) String() string {
+	switch outcome {
+	case TransCommit:
+		return "Commit"
+	case TransRollback:
+		return "Rollback"
+	case TransTimeout:
+		return "Timeout"
+	}
+	return fmt.Sprintf("TransOutcome(%d)", outcome)
+}
+
+// ErrTransShutdown ShutdownTrans 时回滚或者拒绝的微事务
+var ErrTransShutdown = errors.New("mdb: trans shutdown")
+
+// TransResult Err 为 deal 返回的错误，或者提交、回滚失败的错误；提交失败时 Outcome 为 TransRollback
+type TransResult struct {
+	TransId string
+	Outcome TransOutcome
+	Err     error
+}
+
+// TransHandle 事务的结果，使用 TransModel 时通过 model.Handle() 获取
+// 微事务在协程中等待提交，ObtainSession 返回 nil 只表示 deal 成功
+type TransHandle struct {
+	transId string
+	once    sync.Once
+	done    chan struct{}
+	result  TransResult
+}
+
+func newTransHandle(transId string) *TransHandle {
+	return &TransHandle{transId: transId, done: make(chan struct{})}
+}
+
+// Done 事务结束时关闭
+func (h *TransHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Result 等待事务结束并返回结果
+func (h *TransHandle) Result() TransResult {
+	<-h.done
+	return h.result
+}
+
+// Wait 等待事务结束，ctx 结束时返回 ctx 的错误，事务仍会继续等待结果
+func (h *TransHandle) Wait(ctx context.Context) (TransResult, error) {
+	select {
+	case <-h.done:
+		return h.result, nil
+	case <-ctx.Done():
+		return TransResult{TransId: h.transId}, ctx.Err()
+	}
+}
+
+// Handle ObtainSession 之后获取事务的结果；没有开启事务时为 nil
+func (model *TransModel) Handle() *TransHandle {
+	return model.handle
+}
+
+// finish 只有第一次有效；先调用 OnDone，再通知等待 Handle 的调用方
+func (model *TransModel) finish(outcome TransOutcome, err error) {
+	if model == nil || model.handle == nil {
+		return
+	}
+	h := model.handle
+	h.once.Do(func() {
+		h.result = TransResult{TransId: h.transId, Outcome: outcome, Err: err}
+		defer close(h.done)
+		if model.OnDone == nil {
+			return
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				log.Errorf("trans %s OnDone panic: %v", h.transId, p)
+			}
+		}()
+		model.OnDone(h.result)
+	})
+}
+
+// transRegistry 等待结果中的微事务，用于 ShutdownTrans
+type transRegistry struct {
+	mu      sync.Mutex
+	closing bool
+	pending map[*TransHandle]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+var deferredTrans = newTransRegistry()
+
+func newTransRegistry() *transRegistry {
+	return &transRegistry{pending: map[*TransHandle]context.CancelFunc{}}
+}
+
+// add 返回等待使用的 ctx，ShutdownTrans 强制结束时被取消
+func (reg *transRegistry) add(model *TransModel) (context.Context, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.closing {
+		return nil, ErrTransShutdown
+	}
+	ctx := model.TimeoutCxt
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	reg.pending[model.handle] = cancel
+	reg.wg.Add(1)
+	return ctx, nil
+}
+
+func (reg *transRegistry) remove(h *TransHandle) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if cancel, ok := reg.pending[h]; ok {
+		cancel()
+		delete(reg.pending, h)
+		reg.wg.Done()
+	}
+}
+
+// ShutdownTrans 停止接受新的微事务，等待所有等待中的微事务结束；
+// ctx 结束时回滚剩余的微事务，结果为 ErrTransShutdown，并返回 ctx 的错误
+func ShutdownTrans(ctx context.Context) error {
+	reg := deferredTrans
+	reg.mu.Lock()
+	reg.closing = true
+	reg.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		reg.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	reg.mu.Lock()
+	for _, cancel := range reg.pending {
+		cancel()
+	}
+	reg.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
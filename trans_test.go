@@ -0,0 +1,405 @@
+package mdb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubRedis 只实现 AUTH SELECT GET SET PUBLISH SUBSCRIBE 的 redis 服务
+type stubRedis struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	values   map[string]string
+	subs     map[string][]net.Conn
+	commands []string
+}
+
+func newStubRedis(t *testing.T, password string) *stubRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &stubRedis{ln: ln, password: password, values: map[string]string{}, subs: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return srv
+}
+
+func (srv *stubRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := srv.password == ""
+	for {
+		args, err := readStubCommand(r)
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, strings.Join(args, " "))
+		reply := ""
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[1] != srv.password {
+				reply = "-WRONGPASS invalid password\r\n"
+			} else {
+				authed, reply = true, "+OK\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			if v, ok := srv.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case cmd == "SET":
+			srv.values[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case cmd == "PUBLISH":
+			msg := fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			for _, sub := range srv.subs[args[1]] {
+				_, _ = sub.Write([]byte(msg))
+			}
+			reply = ":" + strconv.Itoa(len(srv.subs[args[1]])) + "\r\n"
+		case cmd == "SUBSCRIBE":
+			srv.subs[args[1]] = append(srv.subs[args[1]], conn)
+			reply = fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		_, err = conn.Write([]byte(reply))
+		srv.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readStubCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if args[i], err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(args[i], "\r\n")
+	}
+	return args, nil
+}
+
+// waitStmts 协程中提交或回滚，等待语句出现
+func waitStmts(t *testing.T, l *fakeLog, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(l.all()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assertStmts(t, l, want...)
+}
+
+func useTransStore(t *testing.T, store TransStatusStore) {
+	old := getTransStore()
+	SetTransStatusStore(store)
+	t.Cleanup(func() { SetTransStatusStore(old) })
+}
+
+func TestMemoryTransStore(t *testing.T) {
+	store := NewMemoryTransStore()
+	if status, _ := store.GetStatus("t1"); status != Pending {
+		t.Errorf("status = %d, want Pending", status)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ := store.Subscribe(ctx, "t1")
+	_ = store.SetStatus("t1", Success)
+	if status := <-ch; status != Success {
+		t.Errorf("pushed status = %d, want Success", status)
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed after ctx done")
+	}
+	if status, _ := store.GetStatus("t1"); status != Success {
+		t.Errorf("status = %d, want Success", status)
+	}
+
+	if err := PublishTransResult("t1", Pending); err == nil {
+		t.Error("publish Pending should fail")
+	}
+}
+
+func TestTransCommit(t *testing.T) {
+	useTransStore(t, NewMemoryTransStore())
+	insert := func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}
+	for _, status := range []int8{Success, Fail} {
+		l := useFakeDb(t)
+		transId := fmt.Sprintf("trans-%d", status)
+		err := ObtainSession(Write, insert, &TransModel{TransId: transId, TimeoutCxt: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStmts(t, l, "BEGIN", "INSERT")
+		if err = PublishTransResult(transId, status); err != nil {
+			t.Fatal(err)
+		}
+		if status == Success {
+			waitStmts(t, l, "BEGIN", "INSERT", "COMMIT")
+		} else {
+			waitStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+		}
+	}
+
+	// 超时回滚
+	l := useFakeDb(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ObtainSession(Write, insert, &TransModel{TransId: "timeout", TimeoutCxt: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	waitStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+}
+
+func TestRedisTransStore(t *testing.T) {
+	srv := newStubRedis(t, "secret")
+	store := NewRedisTransStore(srv.ln.Addr().String())
+	store.Password = "secret"
+	store.DB = 2
+	status, err := store.GetStatus("t1")
+	if err != nil || status != Pending {
+		t.Fatalf("status = %d, err = %v, want Pending", status, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := store.Subscribe(ctx, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetStatus("t1", Fail); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case status = <-ch:
+		if status != Fail {
+			t.Errorf("pushed status = %d, want Fail", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no status pushed")
+	}
+	if status, err = store.GetStatus("t1"); err != nil || status != Fail {
+		t.Errorf("status = %d, err = %v, want Fail", status, err)
+	}
+	srv.mu.Lock()
+	commands := strings.Join(srv.commands, "\n")
+	srv.mu.Unlock()
+	for _, want := range []string{"AUTH secret", "SELECT 2", "SUBSCRIBE mdb:trans:t1", "SET mdb:trans:t1 1 EX 86400", "PUBLISH mdb:trans:t1 1"} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("commands %q should contain %q", commands, want)
+		}
+	}
+
+	bad := NewRedisTransStore(srv.ln.Addr().String())
+	if _, err = bad.GetStatus("t1"); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("err = %v, want NOAUTH", err)
+	}
+
+	// 订阅的推送触发提交
+	useTransStore(t, store)
+	l := useFakeDb(t)
+	err = ObtainSession(Write, func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}, &TransModel{TransId: "t2", TimeoutCxt: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = PublishTransResult("t2", Success); err != nil {
+		t.Fatal(err)
+	}
+	waitStmts(t, l, "BEGIN", "INSERT", "COMMIT")
+}
+
+func useTransRegistry(t *testing.T) {
+	old := deferredTrans
+	deferredTrans = newTransRegistry()
+	t.Cleanup(func() { deferredTrans = old })
+}
+
+func TestTransHandle(t *testing.T) {
+	useTransStore(t, NewMemoryTransStore())
+	insert := func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}
+	var mu sync.Mutex
+	var callbacks []TransResult
+	onDone := func(result TransResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		callbacks = append(callbacks, result)
+	}
+
+	useFakeDb(t)
+	success := &TransModel{TransId: "h1", TimeoutCxt: context.Background(), OnDone: onDone}
+	fail := &TransModel{TransId: "h2", TimeoutCxt: context.Background(), OnDone: onDone}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	timeout := &TransModel{TransId: "h3", TimeoutCxt: ctx, OnDone: onDone}
+	for _, model := range []*TransModel{success, fail, timeout} {
+		if err := ObtainSession(Write, insert, model); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-model.Handle().Done():
+			t.Fatalf("%s should be pending", model.TransId)
+		default:
+		}
+	}
+	_ = PublishTransResult("h1", Success)
+	_ = PublishTransResult("h2", Fail)
+	if r := success.Handle().Result(); r.Outcome != TransCommit || r.Err != nil {
+		t.Errorf("h1 result = %+v, want Commit", r)
+	}
+	if r := fail.Handle().Result(); r.Outcome != TransRollback || r.Err != nil {
+		t.Errorf("h2 result = %+v, want Rollback", r)
+	}
+	if r, err := timeout.Handle().Wait(context.Background()); err != nil || r.Outcome != TransTimeout {
+		t.Errorf("h3 result = %+v, err = %v, want Timeout", r, err)
+	}
+	mu.Lock()
+	if len(callbacks) != 3 {
+		t.Errorf("callbacks = %+v, want 3", callbacks)
+	}
+	mu.Unlock()
+
+	// deal 失败和没有 TransId 时也有结果
+	want := fmt.Errorf("deal failed")
+	model := &TransModel{TransId: "h4"}
+	if err := ObtainSession(Write, func(sess *Session) error { return want }, model); err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	if r := model.Handle().Result(); r.Outcome != TransRollback || r.Err != want {
+		t.Errorf("h4 result = %+v, want Rollback %v", r, want)
+	}
+	model = &TransModel{}
+	if err := ObtainSession(Write, insert, model); err != nil {
+		t.Fatal(err)
+	}
+	if r := model.Handle().Result(); r.Outcome != TransCommit || r.Err != nil {
+		t.Errorf("result = %+v, want Commit", r)
+	}
+}
+
+// TestTransCommitFailed COMMIT 失败时结果为回滚
+func TestTransCommitFailed(t *testing.T) {
+	useTransStore(t, NewMemoryTransStore())
+	insert := func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}
+	l := useFakeDb(t)
+	want := fmt.Errorf("commit failed")
+	l.fail = func(stmt string) error {
+		if stmt == "COMMIT" {
+			return want
+		}
+		return nil
+	}
+	model := &TransModel{}
+	if err := ObtainSession(Write, insert, model); err == nil {
+		t.Fatal("commit should fail")
+	}
+	if r := model.Handle().Result(); r.Outcome != TransRollback || r.Err == nil {
+		t.Errorf("result = %+v, want Rollback", r)
+	}
+	model = &TransModel{TransId: "c1", TimeoutCxt: context.Background()}
+	if err := ObtainSession(Write, insert, model); err != nil {
+		t.Fatal(err)
+	}
+	_ = PublishTransResult("c1", Success)
+	if r := model.Handle().Result(); r.Outcome != TransRollback || r.Err == nil {
+		t.Errorf("c1 result = %+v, want Rollback", r)
+	}
+}
+
+func TestShutdownTrans(t *testing.T) {
+	useTransStore(t, NewMemoryTransStore())
+	useTransRegistry(t)
+	insert := func(sess *Session) error {
+		return sess.Model(&Student{ID: NewVarchar("1")}).Insert()
+	}
+	useFakeDb(t)
+	done := &TransModel{TransId: "s1", TimeoutCxt: context.Background()}
+	pending := &TransModel{TransId: "s2", TimeoutCxt: context.Background()}
+	for _, model := range []*TransModel{done, pending} {
+		if err := ObtainSession(Write, insert, model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = PublishTransResult("s1", Success)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ShutdownTrans(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if r := done.Handle().Result(); r.Outcome != TransCommit {
+		t.Errorf("s1 result = %+v, want Commit", r)
+	}
+	if r := pending.Handle().Result(); r.Outcome != TransRollback || r.Err != ErrTransShutdown {
+		t.Errorf("s2 result = %+v, want Rollback %v", r, ErrTransShutdown)
+	}
+
+	// 之后的微事务直接回滚
+	l := useFakeDb(t)
+	model := &TransModel{TransId: "s3", TimeoutCxt: context.Background()}
+	if err := ObtainSession(Write, insert, model); err != ErrTransShutdown {
+		t.Errorf("err = %v, want %v", err, ErrTransShutdown)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT", "ROLLBACK")
+	if r := model.Handle().Result(); r.Outcome != TransRollback || r.Err != ErrTransShutdown {
+		t.Errorf("s3 result = %+v", r)
+	}
+
+	// 全部结束时不需要等到 ctx 结束
+	useTransRegistry(t)
+	model = &TransModel{TransId: "s4", TimeoutCxt: context.Background()}
+	if err := ObtainSession(Write, insert, model); err != nil {
+		t.Fatal(err)
+	}
+	_ = PublishTransResult("s4", Fail)
+	if err := ShutdownTrans(context.Background()); err != nil {
+		t.Errorf("shutdown err = %v", err)
+	}
+	if r := model.Handle().Result(); r.Outcome != TransRollback || r.Err != nil {
+		t.Errorf("s4 result = %+v", r)
+	}
+}
@@ -11,12 +11,13 @@ import (
 
 // TableStruct 表结构描述
 type TableStruct struct {
-	TableName   string
-	Columns     []string
-	PrimaryKeys []string
-	Indexes     []string
-	ColumnTypes map[string]string
-	Constraints map[string]string
+	TableName      string
+	Columns        []string
+	PrimaryKeys    []string
+	Indexes        []string
+	SpatialIndexes []string // 空间索引，point 等列使用，列必须 not null
+	ColumnTypes    map[string]string
+	Constraints    map[string]string
 }
 
 // TableCompare 对比结构
@@ -36,7 +37,8 @@ type ColumnCompare struct {
 	AddPrimary    []string
 	NeedDropPrimary    bool  // 是否需要drop（比如一个表中原来没有 primary 后来加了一个）
 	AddIndex      []string
-	DropIndex     []string
+	AddSpatialIndex []string
+	DropIndex     []string // 包括空间索引，删除的语句是一样的
 	ColumnChanged []RecordCompare
 }
 
@@ -55,6 +57,20 @@ type RecordCompare struct {
 	LocalColumn ColumnDetail
 }
 
+// lengthTypes 需要通过 length 描述长度的类型，长度是类型的一部分，比较的时候不能忽略
+var lengthTypes = map[string]bool{
+	"varchar": true, "char": true, "decimal": true, "binary": true, "varbinary": true,
+}
+
+// valuesTypes 允许的值在 tag 中声明的类型，如 mdb:"enum:active,disabled"，值是类型的一部分
+var valuesTypes = map[string]bool{"enum": true, "set": true}
+
+// noDefaultTypes 不能有默认值的类型
+var noDefaultTypes = map[string]bool{
+	"text": true, "mediumtext": true, "longtext": true, "blob": true, "mediumblob": true, "longblob": true,
+	"json": true, "point": true,
+}
+
 // Sql2Struct 将数据库的create table sql 语句转换成 TableStruct
 func Sql2Struct(createTableSql string) (tableStruct TableStruct) {
 	tableStruct.ColumnTypes = make(map[string]string)
@@ -71,6 +87,16 @@ func Sql2Struct(createTableSql string) (tableStruct TableStruct) {
 			column := stmt[start+1 : end]
 			tableStruct.Columns = append(tableStruct.Columns, column)
 			columnType := strings.Split(stmt, " ")[1]
+			// enum('in progress','done') 的值中可能有空格
+			if strings.Contains(columnType, "(") && !strings.Contains(columnType, ")") {
+				typeStart := strings.Index(stmt, columnType)
+				columnType = stmt[typeStart : typeStart+strings.Index(stmt[typeStart:], ")")+1]
+			}
+			// unsigned 是类型的一部分，不是约束，如 bigint(20) unsigned
+			if fields := strings.Split(stmt, " "); len(fields) > 2 &&
+				strings.TrimRight(strings.ToLower(fields[2]), ",") == "unsigned" {
+				columnType += " " + fields[2]
+			}
 			if column == "db_decimal" {
 				print("jjj")
 			}
@@ -89,6 +115,11 @@ func Sql2Struct(createTableSql string) (tableStruct TableStruct) {
 			start := strings.Index(stmt, "(")
 			end := strings.LastIndex(stmt, ")")
 			tableStruct.PrimaryKeys = strings.Split(stmt[start+1:end], ",")
+		} else if strings.HasPrefix(stmt, "SPATIAL KEY ") {
+			stmt = strings.Replace(stmt, "`", "", -1)
+			start := strings.Index(stmt, "(")
+			end := strings.LastIndex(stmt, ")")
+			tableStruct.SpatialIndexes = append(tableStruct.SpatialIndexes, stmt[start+1:end])
 		} else if strings.HasPrefix(stmt, "KEY ") {
 			stmt = strings.Replace(stmt, "`", "", -1)
 			start := strings.Index(stmt, "(")
@@ -96,19 +127,24 @@ func Sql2Struct(createTableSql string) (tableStruct TableStruct) {
 			tableStruct.Indexes = append(tableStruct.Indexes, stmt[start+1:end])
 		}
 	}
-	// 只有 varchar 和 Decimal 才有实际意义的长度，其他的没有
+	// 只有 lengthTypes 才有实际意义的长度，其他的（int(11) year(4)）没有；bigint(20) unsigned 为 bigint unsigned
+	// enum set 的值区分大小写
 	_ctMap := make(map[string]string)
 	for column, cType := range tableStruct.ColumnTypes {
-		if strings.HasPrefix(cType, "varchar") || strings.HasPrefix(cType, "decimal") {
-			_ctMap[column] = cType
-			continue
-		}
 		start := strings.Index(cType, "(")
 		if start == -1 {
-			_ctMap[column] = cType
+			_ctMap[column] = strings.ToLower(cType)
 			continue
 		}
-		_ctMap[column] = cType[:start]
+		name := strings.ToLower(cType[:start])
+		end := strings.LastIndex(cType, ")")
+		if valuesTypes[name] {
+			_ctMap[column] = name + cType[start:]
+		} else if lengthTypes[name] {
+			_ctMap[column] = name + strings.ToLower(cType[start:])
+		} else {
+			_ctMap[column] = name + strings.ToLower(cType[end+1:])
+		}
 	}
 	tableStruct.ColumnTypes = _ctMap
 	return
@@ -122,27 +158,40 @@ func Model2Struct(model interface{}) (tableStruct TableStruct) {
 	if rt.Kind() != reflect.Ptr {
 		log.Panic("table must a pointer!")
 	}
-	// 获取表明并替换
-	_array := strings.Split(rt.String(), ".")
-	tableStruct.TableName = UnMarshal4Camel(_array[len(_array)-1])
-	rte := reflect.TypeOf(model).Elem() //通过反射获取type定义
-	for i := 0; i < rte.NumField(); i++ {
+	// 获取表明并替换，元信息已经缓存，关联字段不是列不在 fields 中
+	meta := getModelMeta(rt)
+	tableStruct.TableName = meta.tableName
+	for _, field := range meta.fields {
 		var sparedDefault bool
-		columnName := UnMarshal4Camel(rte.Field(i).Name)
+		columnName := field.column
 		tableStruct.Columns = append(tableStruct.Columns, columnName)
-		constraint := strings.ToLower(rte.Field(i).Tag.Get("mdb"))
-		if strings.Index(constraint, "index") != -1 {
+		constraint := field.tag
+		if valuesTypes[field.sqlType] {
+			if len(field.values) == 0 {
+				log.WithFields(log.Fields{
+					"table": tableStruct.TableName, "column": columnName, "type": field.sqlType,
+				}).Panicf("对应类型请通过%s字段描述允许的值！", field.sqlType)
+			}
+			// 允许的值不作为约束，也不参与 index default 等的判断
+			constraint = strings.Replace(constraint, strings.ToLower(field.sqlType+":"+strings.Join(field.values, ",")), "", 1)
+		}
+		if strings.Index(constraint, "spatial index") != -1 {
+			tableStruct.SpatialIndexes = append(tableStruct.SpatialIndexes, columnName)
+			constraint = strings.Replace(constraint, "spatial index", "", 1)
+			// 空间索引的列必须 not null
+			if strings.Index(constraint, "not null") == -1 {
+				constraint += " not null"
+			}
+		} else if strings.Index(constraint, "index") != -1 {
 			tableStruct.Indexes = append(tableStruct.Indexes, columnName)
 		}
 		if strings.Index(constraint, "primary key") != -1 {
 			tableStruct.PrimaryKeys = append(tableStruct.PrimaryKeys, columnName)
 			sparedDefault = true
 		}
-		_array = strings.Split(rte.Field(i).Type.String(), ".")
-		dbType := strings.Replace(_array[len(_array)-1], "mdb", "", 1)
-		if dbType == "Bool" {
-			dbType = "Tinyint"
-		} else if dbType == "Varchar" || dbType == "Decimal" {
+		// 类型名来自 Column.SqlType
+		dbType := field.sqlType
+		if lengthTypes[dbType] {
 			lengthStart := strings.Index(constraint, "length:")
 			if lengthStart == -1 {
 				log.WithFields(log.Fields{
@@ -159,10 +208,21 @@ func Model2Struct(model interface{}) (tableStruct TableStruct) {
 			constraint = strings.Replace(constraint, "length:", "", 1)
 			constraint = strings.Replace(constraint, length, "", 1)
 		}
-		if dbType == "Text" || dbType == "Blob" {
+		if noDefaultTypes[dbType] {
 			sparedDefault = true
 		}
+		// 空间索引需要列声明 SRID
+		if dbType == "point" {
+			constraint = fmt.Sprintf("srid %d %s", SRID, strings.TrimSpace(constraint))
+		}
 		tableStruct.ColumnTypes[columnName] = strings.ToLower(dbType)
+		if valuesTypes[dbType] {
+			quoted := make([]string, len(field.values))
+			for i, v := range field.values {
+				quoted[i] = "'" + strings.Replace(v, "'", "''", -1) + "'"
+			}
+			tableStruct.ColumnTypes[columnName] = fmt.Sprintf("%s(%s)", dbType, strings.Join(quoted, ","))
+		}
 		constraint = strings.Replace(constraint, "index", "", 1)
 		constraint = strings.Replace(constraint, "primary key", "", 1)
 		if strings.Index(constraint, "default") == -1 &&
@@ -215,6 +275,9 @@ func (local TableStruct) Compare(remote TableStruct) (singleCompare ColumnCompar
 	singleCompare.TableName = local.TableName
 	// 比较大块 column index primary key
 	singleCompare.AddIndex, singleCompare.DropIndex = findDiff(local.Indexes, remote.Indexes)
+	var dropSpatial []string
+	singleCompare.AddSpatialIndex, dropSpatial = findDiff(local.SpatialIndexes, remote.SpatialIndexes)
+	singleCompare.DropIndex = append(singleCompare.DropIndex, dropSpatial...)
 	addArray, dropArray := findDiff(local.PrimaryKeys, remote.PrimaryKeys)
 	if len(dropArray) != 0 { // 只要不一样就重新建，mysql 主键 drop 机制决定的
 		singleCompare.AddPrimary = local.PrimaryKeys
@@ -304,6 +367,10 @@ func (local TableStruct) GenCreateTableSql(charset string) string {
 		sqlBuilder = append(sqlBuilder, fmt.Sprintf("\tKEY `idx_%s_%s` (`%s`)",
 			local.TableName, index, index))
 	}
+	for _, index := range local.SpatialIndexes {
+		sqlBuilder = append(sqlBuilder, fmt.Sprintf("\tSPATIAL KEY `idx_%s_%s` (`%s`)",
+			local.TableName, index, index))
+	}
 	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (\n%s\n) ENGINE=InnoDB DEFAULT CHARSET=%s",
 		local.TableName, strings.Join(sqlBuilder, ",\n"), charset)
 }
@@ -340,6 +407,10 @@ func (columnCompare ColumnCompare) GenColumnSql() (sqlBuilder []string) {
 		sqlBuilder = append(sqlBuilder, fmt.Sprintf("ALTER TABLE %s ADD INDEX idx_%s_%s (`%s`)",
 			columnCompare.TableName, columnCompare.TableName, index, index))
 	}
+	for _, index := range columnCompare.AddSpatialIndex {
+		sqlBuilder = append(sqlBuilder, fmt.Sprintf("ALTER TABLE %s ADD SPATIAL INDEX idx_%s_%s (`%s`)",
+			columnCompare.TableName, columnCompare.TableName, index, index))
+	}
 	// 处理变化的，这里直接简单粗暴，变化的就直接删除了。测试环境和生产环境上是给出差异化提示，手动编写migrate 文件
 	for _, columnRecord := range columnCompare.ColumnChanged {
 		sqlBuilder = append(sqlBuilder, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s",
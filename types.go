@@ -1,9 +1,13 @@
 package mdb
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"github.com/shopspring/decimal"
-	"strconv"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -18,308 +22,338 @@ const (
 	OpNotIn
 	OpGroupAnd
 	OpGroupOr
+	OpExpr // 函数表达式，如 JSON_CONTAINS，One 即为完整的条件
 )
 
 type Opt struct {
 	// 就是具体表的struct 引用，在db.Model时候赋值，承载所有的Mark操作
 	tableName     string
 	dbColumnName  string
-	orgColumnName string // 原始struct的表名，首字母大写
-}
+	orgColumnName string  // 原始struct的表名，首字母大写
+	arg           kindArg // 和该列比较的值的转换，如 uuid
+}
+
+// 具体的列类型都基于 Col，第二个参数描述 sql 类型和 scan 的转换
+// 新增类型只需要在这里声明一个 kind 和对应的别名
+type (
+	Varchar  = Col[string, varcharKind]
+	Text     = Col[string, textKind]
+	Blob     = Col[[]byte, blobKind]
+	Tinyint  = Col[int8, tinyintKind]
+	Smallint = Col[int16, smallintKind]
+	Int      = Col[int32, intKind]
+	Bigint   = Col[int64, bigintKind]
+	Float    = Col[float32, floatKind]
+	Double   = Col[float64, doubleKind]
+	Decimal  = Col[decimal.Decimal, decimalKind]
+	Datetime = Col[time.Time, datetimeKind]
+	Bool     = Col[bool, boolKind]
+
+	Char       = Col[string, charKind]
+	MediumText = Col[string, mediumTextKind]
+	LongText   = Col[string, longTextKind]
+	Binary     = Col[[]byte, binaryKind]
+	Varbinary  = Col[[]byte, varbinaryKind]
+	MediumBlob = Col[[]byte, mediumBlobKind]
+	LongBlob   = Col[[]byte, longBlobKind]
+	Mediumint  = Col[int32, mediumintKind]
+	Year       = Col[int16, yearKind]
+	Date       = Col[time.Time, dateKind]
+	Time       = Col[time.Duration, timeKind]
+	Timestamp  = Col[time.Time, timestampKind]
+
+	Uint8  = Col[uint8, uint8Kind]
+	Uint16 = Col[uint16, uint16Kind]
+	Uint32 = Col[uint32, uint32Kind]
+	Uint64 = Col[uint64, uint64Kind]
+
+	Enum = Col[string, enumKind]
+	Set  = Col[[]string, setKind]
+
+	Point = Col[GeoPoint, pointKind]
+
+	UUID        = Col[UUIDValue, uuidKind]
+	OrderedUUID = Col[UUIDValue, orderedUUIDKind]
+)
 
-type Varchar struct {
-	V      string
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+// NewVarchar 等构造有值的列，零值也会写入数据库，如 NewInt(0) NewBool(false)
+// 显式 null 使用 Null[Int]()，什么都不赋值的列 insert update 忽略
+func NewVarchar(v string) Varchar          { return Varchar{V: v, NotNul: true} }
+func NewText(v string) Text                { return Text{V: v, NotNul: true} }
+func NewBlob(v []byte) Blob                { return Blob{V: v, NotNul: true} }
+func NewTinyint(v int8) Tinyint            { return Tinyint{V: v, NotNul: true} }
+func NewSmallint(v int16) Smallint         { return Smallint{V: v, NotNul: true} }
+func NewInt(v int32) Int                   { return Int{V: v, NotNul: true} }
+func NewBigint(v int64) Bigint             { return Bigint{V: v, NotNul: true} }
+func NewFloat(v float32) Float             { return Float{V: v, NotNul: true} }
+func NewDouble(v float64) Double           { return Double{V: v, NotNul: true} }
+func NewDecimal(v decimal.Decimal) Decimal { return Decimal{V: v, NotNul: true} }
+func NewDatetime(v time.Time) Datetime     { return Datetime{V: v, NotNul: true} }
+func NewBool(v bool) Bool                  { return Bool{V: v, NotNul: true} }
+func NewChar(v string) Char                { return Char{V: v, NotNul: true} }
+func NewMediumText(v string) MediumText    { return MediumText{V: v, NotNul: true} }
+func NewLongText(v string) LongText        { return LongText{V: v, NotNul: true} }
+func NewBinary(v []byte) Binary            { return Binary{V: v, NotNul: true} }
+func NewVarbinary(v []byte) Varbinary      { return Varbinary{V: v, NotNul: true} }
+func NewMediumBlob(v []byte) MediumBlob    { return MediumBlob{V: v, NotNul: true} }
+func NewLongBlob(v []byte) LongBlob        { return LongBlob{V: v, NotNul: true} }
+func NewMediumint(v int32) Mediumint       { return Mediumint{V: v, NotNul: true} }
+func NewYear(v int16) Year                 { return Year{V: v, NotNul: true} }
+func NewDate(v time.Time) Date             { return Date{V: v, NotNul: true} }
+func NewTime(v time.Duration) Time         { return Time{V: v, NotNul: true} }
+func NewTimestamp(v time.Time) Timestamp   { return Timestamp{V: v, NotNul: true} }
+func NewUint8(v uint8) Uint8               { return Uint8{V: v, NotNul: true} }
+func NewUint16(v uint16) Uint16            { return Uint16{V: v, NotNul: true} }
+func NewUint32(v uint32) Uint32            { return Uint32{V: v, NotNul: true} }
+func NewUint64(v uint64) Uint64            { return Uint64{V: v, NotNul: true} }
+func NewEnum(v string) Enum                { return Enum{V: v, NotNul: true} }
+func NewSet(v ...string) Set               { return Set{V: append([]string{}, v...), NotNul: true} }
+func NewPoint(lat, lng float64) Point      { return Point{V: GeoPoint{Lat: lat, Lng: lng}, NotNul: true} }
+func NewUUID(v UUIDValue) UUID             { return UUID{V: v, NotNul: true} }
+func NewOrderedUUID(v UUIDValue) OrderedUUID {
+	return OrderedUUID{V: v, NotNul: true}
 }
 
-func (dbVarchar *Varchar) Scan(src interface{}) error {
-	if src == nil {
-		dbVarchar.V = ""
-		dbVarchar.NotNul = false
-		dbVarchar.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbVarchar.NotNul = true
-	dbVarchar.V = valStr
-	dbVarchar.Raw = dbVarchar.V
-	return nil
-}
-
-type Text struct {
-	V      string
-	NotNul bool
-	Raw    interface{}   // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
-}
-
-func (dbText *Text) Scan(src interface{}) error {
-	if src == nil {
-		dbText.V = ""
-		dbText.NotNul = false
-		dbText.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbText.NotNul = true
-	dbText.V = valStr
-	dbText.Raw = dbText.V
-	return nil
-}
-
-type Blob struct {
-	V      []byte
-	NotNul bool
-	Raw    interface{}   // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
-}
-
-func (dbBlob *Blob) Scan(src interface{}) error {
-	if src == nil {
-		dbBlob.V = nil
-		dbBlob.NotNul = false
-		dbBlob.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	dbBlob.NotNul = true
-	dbBlob.V = b
-	dbBlob.Raw = dbBlob.V
-	return nil
-}
-
-type Tinyint struct {
-	V      int8
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
-}
-
-func (dbTinyint *Tinyint) Scan(src interface{}) error {
-	if src == nil {
-		dbTinyint.V = 0
-		dbTinyint.NotNul = false
-		dbTinyint.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbTinyint.NotNul = true
-	var v int
-	v, err := strconv.Atoi(valStr)
-	if err != nil {
-		return err
-	}
-	dbTinyint.V = int8(v)
-	dbTinyint.Raw = dbTinyint.V
-	return nil
-}
+type varcharKind struct{}
 
-type Smallint struct {
-	V      int16
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+func (varcharKind) SqlType() string                         { return "varchar" }
+func (varcharKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+type textKind struct{}
+
+func (textKind) SqlType() string                         { return "text" }
+func (textKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+type blobKind struct{}
+
+func (blobKind) SqlType() string                         { return "blob" }
+func (blobKind) Convert(src interface{}) ([]byte, error) { return asBytes(src) }
+
+type tinyintKind struct{}
+
+func (tinyintKind) SqlType() string { return "tinyint" }
+func (tinyintKind) Convert(src interface{}) (int8, error) {
+	v, err := asInt(src, 8)
+	return int8(v), err
 }
 
-func (dbSmallint *Smallint) Scan(src interface{}) error {
-	if src == nil {
-		dbSmallint.V = 0
-		dbSmallint.NotNul = false
-		dbSmallint.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbSmallint.NotNul = true
-	var v int
-	v, err := strconv.Atoi(valStr)
-	if err != nil {
-		return err
-	}
-	dbSmallint.V = int16(v)
-	dbSmallint.Raw = nil
-	return nil
+type smallintKind struct{}
+
+func (smallintKind) SqlType() string { return "smallint" }
+func (smallintKind) Convert(src interface{}) (int16, error) {
+	v, err := asInt(src, 16)
+	return int16(v), err
 }
 
-type Int struct {
-	V      int32
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+type intKind struct{}
+
+func (intKind) SqlType() string { return "int" }
+func (intKind) Convert(src interface{}) (int32, error) {
+	v, err := asInt(src, 32)
+	return int32(v), err
 }
 
-func (dbInt *Int) Scan(src interface{}) error {
-	if src == nil {
-		dbInt.V = 0
-		dbInt.NotNul = false
-		dbInt.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbInt.NotNul = true
-	var v int
-	v, err := strconv.Atoi(valStr)
-	if err != nil {
-		return err
-	}
-	dbInt.V = int32(v)
-	dbInt.Raw = dbInt.V
-	return nil
+type bigintKind struct{}
+
+func (bigintKind) SqlType() string                        { return "bigint" }
+func (bigintKind) Convert(src interface{}) (int64, error) { return asInt(src, 64) }
+
+type floatKind struct{}
+
+func (floatKind) SqlType() string { return "float" }
+func (floatKind) Convert(src interface{}) (float32, error) {
+	v, err := asFloat(src, 32)
+	return float32(v), err
 }
 
-type Bigint struct {
-	V      int64
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+type doubleKind struct{}
+
+func (doubleKind) SqlType() string                          { return "double" }
+func (doubleKind) Convert(src interface{}) (float64, error) { return asFloat(src, 64) }
+
+type decimalKind struct{}
+
+func (decimalKind) SqlType() string                                  { return "decimal" }
+func (decimalKind) Convert(src interface{}) (decimal.Decimal, error) { return asDecimal(src) }
+
+type datetimeKind struct{}
+
+func (datetimeKind) SqlType() string                            { return "datetime" }
+func (datetimeKind) Convert(src interface{}) (time.Time, error) { return asTime(src) }
+
+// boolKind 数据库中使用 tinyint 存储
+type boolKind struct{}
+
+func (boolKind) SqlType() string                       { return "tinyint" }
+func (boolKind) Convert(src interface{}) (bool, error) { return asBool(src) }
+
+type charKind struct{}
+
+func (charKind) SqlType() string                         { return "char" }
+func (charKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+type mediumTextKind struct{}
+
+func (mediumTextKind) SqlType() string                         { return "mediumtext" }
+func (mediumTextKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+type longTextKind struct{}
+
+func (longTextKind) SqlType() string                         { return "longtext" }
+func (longTextKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+// binaryKind 定长，不足的部分数据库会补 0x00，scan 回来的长度总是 length
+type binaryKind struct{}
+
+func (binaryKind) SqlType() string                         { return "binary" }
+func (binaryKind) Convert(src interface{}) ([]byte, error) { return asBytes(src) }
+
+type varbinaryKind struct{}
+
+func (varbinaryKind) SqlType() string                         { return "varbinary" }
+func (varbinaryKind) Convert(src interface{}) ([]byte, error) { return asBytes(src) }
+
+type mediumBlobKind struct{}
+
+func (mediumBlobKind) SqlType() string                         { return "mediumblob" }
+func (mediumBlobKind) Convert(src interface{}) ([]byte, error) { return asBytes(src) }
+
+type longBlobKind struct{}
+
+func (longBlobKind) SqlType() string                         { return "longblob" }
+func (longBlobKind) Convert(src interface{}) ([]byte, error) { return asBytes(src) }
+
+// mediumintKind 3 个字节，-8388608 到 8388607
+type mediumintKind struct{}
+
+func (mediumintKind) SqlType() string { return "mediumint" }
+func (mediumintKind) Convert(src interface{}) (int32, error) {
+	v, err := asInt(src, 24)
+	return int32(v), err
 }
 
-func (dbBigint *Bigint) Scan(src interface{}) error {
-	if src == nil {
-		dbBigint.V = 0
-		dbBigint.NotNul = false
-		dbBigint.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbBigint.NotNul = true
-	var v int64
-	v, err := strconv.ParseInt(valStr, 10, 64)
-	if err != nil {
-		return err
+// yearKind 1901 到 2155，0 表示 0000
+type yearKind struct{}
+
+func (yearKind) SqlType() string { return "year" }
+func (yearKind) Convert(src interface{}) (int16, error) {
+	v, err := asInt(src, 16)
+	if err == nil && v != 0 && (v < 1901 || v > 2155) {
+		return 0, errConvert(src, "year")
 	}
-	dbBigint.V = v
-	dbBigint.Raw = dbBigint.V
-	return nil
+	return int16(v), err
 }
 
-type Float struct {
-	V      float32
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+// dateKind 只有日期部分，json 文本为 2006-01-02
+type dateKind struct{}
+
+func (dateKind) SqlType() string                            { return "date" }
+func (dateKind) Convert(src interface{}) (time.Time, error) { return asTime(src) }
+func (dateKind) Format(v time.Time) string                  { return v.Format("2006-01-02") }
+
+// timeKind mysql 的 time 是时长（可以为负，可以超过 24 小时），使用 time.Duration
+type timeKind struct{}
+
+func (timeKind) SqlType() string                                { return "time" }
+func (timeKind) Convert(src interface{}) (time.Duration, error) { return asDuration(src) }
+func (timeKind) Value(v time.Duration) (driver.Value, error)    { return formatDuration(v), nil }
+func (timeKind) Format(v time.Duration) string                  { return formatDuration(v) }
+
+type timestampKind struct{}
+
+func (timestampKind) SqlType() string                            { return "timestamp" }
+func (timestampKind) Convert(src interface{}) (time.Time, error) { return asTime(src) }
+
+// uint8Kind 等 unsigned 整数，sql 类型带 unsigned，和 show create table 的格式一致
+type uint8Kind struct{}
+
+func (uint8Kind) SqlType() string { return "tinyint unsigned" }
+func (uint8Kind) Convert(src interface{}) (uint8, error) {
+	v, err := asUint(src, 8)
+	return uint8(v), err
 }
 
-func (dbFloat *Float) Scan(src interface{}) error {
-	if src == nil {
-		dbFloat.V = 0
-		dbFloat.NotNul = false
-		dbFloat.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbFloat.NotNul = true
-	var v float64
-	v, err := strconv.ParseFloat(valStr, 64)
-	if err != nil {
-		return err
-	}
-	dbFloat.V = float32(v)
-	dbFloat.Raw = dbFloat.V
-	return nil
+type uint16Kind struct{}
+
+func (uint16Kind) SqlType() string { return "smallint unsigned" }
+func (uint16Kind) Convert(src interface{}) (uint16, error) {
+	v, err := asUint(src, 16)
+	return uint16(v), err
 }
 
-type Double struct {
-	V      float64
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+type uint32Kind struct{}
+
+func (uint32Kind) SqlType() string { return "int unsigned" }
+func (uint32Kind) Convert(src interface{}) (uint32, error) {
+	v, err := asUint(src, 32)
+	return uint32(v), err
 }
 
-func (dbDouble *Double) Scan(src interface{}) error {
-	if src == nil {
-		dbDouble.V = 0
-		dbDouble.NotNul = false
-		dbDouble.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbDouble.NotNul = true
-	var v float64
-	v, err := strconv.ParseFloat(valStr, 64)
-	if err != nil {
-		return err
+// uint64Kind 超过 int64 的值 database/sql 默认不支持，直接交给 driver（go-sql-driver/mysql 支持 uint64）
+type uint64Kind struct{}
+
+func (uint64Kind) SqlType() string                         { return "bigint unsigned" }
+func (uint64Kind) Convert(src interface{}) (uint64, error) { return asUint(src, 64) }
+func (uint64Kind) Value(v uint64) (driver.Value, error) {
+	if v > math.MaxInt64 {
+		return v, nil
 	}
-	dbDouble.V = v
-	dbDouble.Raw = dbDouble.V
-	return nil
+	return int64(v), nil
 }
 
-type Decimal struct {
-	V      decimal.Decimal
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
-}
+// enumKind 允许的值通过 tag 声明，如 mdb:"enum:active,disabled"，insert update 前校验
+type enumKind struct{}
 
-func (dbDecimal *Decimal) Scan(src interface{}) error {
-	if src == nil {
-		dbDecimal.V = decimal.Zero
-		dbDecimal.NotNul = false
-		dbDecimal.Raw = nil
-		return nil
-	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbDecimal.NotNul = true
-	dbDecimal.V = decimal.RequireFromString(valStr)
-	dbDecimal.Raw = valStr
-	return nil
-}
-
-type Datetime struct {
-	V      time.Time
-	NotNul bool
-	Raw    interface{}   // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
-}
-
-func (dbDatetime *Datetime) Scan(src interface{}) error {
-	if src == nil {
-		dbDatetime.NotNul = false
-		dbDatetime.Raw = nil
-		return nil
+func (enumKind) SqlType() string                         { return "enum" }
+func (enumKind) Convert(src interface{}) (string, error) { return asString(src) }
+
+// setKind 允许的值通过 tag 声明，如 mdb:"set:read,write"，数据库中为逗号分隔的字符串
+type setKind struct{}
+
+func (setKind) SqlType() string { return "set" }
+func (setKind) Convert(src interface{}) ([]string, error) {
+	s, err := asString(src)
+	if err != nil || s == "" {
+		return []string{}, err
 	}
-	dbDatetime.NotNul = true
-	dbDatetime.V = src.(time.Time)
-	dbDatetime.Raw = dbDatetime.V
-	return nil
+	return strings.Split(s, ","), nil
 }
+func (setKind) Value(v []string) (driver.Value, error) { return strings.Join(v, ","), nil }
+
+// pointKind 迁移时为 point srid 4326，需要空间索引使用 mdb:"spatial index"
+type pointKind struct{}
 
-type Bool struct {
-	V      bool
-	NotNul bool
-	Raw    interface{}  // 针对 select-map 有效。不用重复判读 NotNul；Insert Update 忽略
-	Opt
+func (pointKind) SqlType() string                           { return "point" }
+func (pointKind) Convert(src interface{}) (GeoPoint, error) { return asPoint(src) }
+func (pointKind) Value(v GeoPoint) (driver.Value, error)    { return pointValue(v), nil }
+
+// JSON json 列，V 为可以 json 序列化的任意类型，如 JSON[Settings] JSON[map[string]interface{}]
+// 泛型别名需要 go1.24，这里内嵌 Col，Opt 的方法同样可以直接使用
+type JSON[T any] struct {
+	Col[T, jsonKind[T]]
 }
 
-func (dbBool *Bool) Scan(src interface{}) error {
-	if src == nil {
-		dbBool.V = false
-		dbBool.NotNul = false
-		dbBool.Raw = nil
-		return nil
+func NewJSON[T any](v T) JSON[T] { return JSON[T]{Col[T, jsonKind[T]]{V: v, NotNul: true}} }
+
+// jsonKind 写入时 json.Marshal，scan 时 json.Unmarshal
+type jsonKind[T any] struct{}
+
+func (jsonKind[T]) SqlType() string { return "json" }
+func (jsonKind[T]) Convert(src interface{}) (T, error) {
+	var v T
+	data, err := asBytes(src)
+	if err != nil {
+		return v, errConvert(src, "json")
 	}
-	b, _ := src.([]byte)
-	valStr := string(b)
-	dbBool.NotNul = true
-	var v int
-	v, err := strconv.Atoi(valStr)
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+func (jsonKind[T]) Value(v T) (driver.Value, error) {
+	data, err := json.Marshal(v)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dbBool.V = !(v == 0)
-	dbBool.Raw = dbBool.V
-	return nil
+	return string(data), nil
 }
 
 // Term On 或者 where 每个条件  中间过渡
@@ -331,6 +365,7 @@ type Term struct {
 	GroupOp    int8
 	Other      string
 	Value      interface{}
+	Args       []interface{} // One 中占位符的参数，在 Value 之前
 }
 
 func (o Opt) Eq(v interface{}) Term {
@@ -353,49 +388,156 @@ func (o Opt) LessEq(v interface{}) Term {
 	return op(o, OpLessEq, v)
 }
 
+// Order 排序描述，通过 Opt.Asc Opt.Desc 获取
+type Order struct {
+	opt  Opt
+	desc bool
+	expr string        // 按表达式排序，如 OrderByDistance，为空时按列排序
+	args []interface{} // expr 中占位符的参数
+}
+
+func (o Opt) Asc() Order {
+	return Order{opt: o}
+}
+
+func (o Opt) Desc() Order {
+	return Order{opt: o, desc: true}
+}
+
+// option 所有列类型都内嵌了 Opt，getOpt 通过它获取
+func (o Opt) option() Opt {
+	return o
+}
+
+// convert 转换和该列比较的值，如 uuid 的字符串
+func (o Opt) convert(v interface{}) interface{} {
+	if o.arg == nil {
+		return v
+	}
+	return o.arg.Arg(v)
+}
+
+// column 返回类似 `table`.column
+func (o Opt) column() string {
+	return fmt.Sprintf("`%s`.%s", o.tableName, o.dbColumnName)
+}
+
+func (order Order) String() string {
+	by := order.opt.column()
+	if order.expr != "" {
+		by = order.expr
+	}
+	if order.desc {
+		return by + " DESC"
+	}
+	return by + " ASC"
+}
+
 //func (o Opt) Between(start, end interface{}) Term {
 //	return op(o, OpLessEq, v)
 //}
 
-//func (o Opt) In(vs ...interface{}) Term {
-//	return op(o, OpIn, v)
-//}
-//
-//func (o Opt) NotIn(vs ...interface{}) Term {
-//	o.Chs = true
-//	return o
-//}
+func (o Opt) In(vs ...interface{}) Term {
+	return op(o, OpIn, vs)
+}
+
+func (o Opt) NotIn(vs ...interface{}) Term {
+	return op(o, OpNotIn, vs)
+}
+
+// JSONPath json 列中的某个路径，通过 Opt.Path 获取，如 cfg.Settings.Path("$.theme").Eq("dark")
+type JSONPath struct {
+	opt  Opt
+	path string
+}
+
+func (o Opt) Path(path string) JSONPath {
+	return JSONPath{opt: o, path: path}
+}
+
+func (p JSONPath) Eq(v interface{}) Term {
+	return p.op(OpEq, v)
+}
+
+func (p JSONPath) Greater(v interface{}) Term {
+	return p.op(OpGreater, v)
+}
+
+func (p JSONPath) GreaterEq(v interface{}) Term {
+	return p.op(OpGreaterEq, v)
+}
+
+func (p JSONPath) Less(v interface{}) Term {
+	return p.op(OpLess, v)
+}
+
+func (p JSONPath) LessEq(v interface{}) Term {
+	return p.op(OpLessEq, v)
+}
+
+func (p JSONPath) In(vs ...interface{}) Term {
+	return p.op(OpIn, vs)
+}
+
+func (p JSONPath) NotIn(vs ...interface{}) Term {
+	return p.op(OpNotIn, vs)
+}
+
+// Contains 路径上的值包含 v（数组包含元素，对象包含键值），v 会被 json 序列化
+func (p JSONPath) Contains(v interface{}) Term {
+	return p.opt.JSONContains(v, p.path)
+}
+
+// op 路径的值通过 JSON_EXTRACT 取出，字符串 数字和 json 的值比较，mysql 会转换
+func (p JSONPath) op(opFlag int8, v interface{}) Term {
+	term := op(p.opt, opFlag, v)
+	term.One = fmt.Sprintf("JSON_EXTRACT(%s, ?)", p.opt.column())
+	term.Args = []interface{}{p.path}
+	return term
+}
+
+// FindInSet set 列包含 v，FIND_IN_SET(v, column)
+func (o Opt) FindInSet(v string) Term {
+	return Term{Op: OpExpr, One: fmt.Sprintf("FIND_IN_SET(?, %s)", o.column()), Args: []interface{}{v}}
+}
+
+// JSONContains JSON_CONTAINS(column, v[, path])，v 会被 json 序列化
+func (o Opt) JSONContains(v interface{}, path ...string) Term {
+	candidate, err := json.Marshal(v)
+	if err != nil {
+		log.Panicf("JSONContains: %v!", err)
+	}
+	term := Term{Op: OpExpr, Args: []interface{}{string(candidate)}}
+	if len(path) != 0 {
+		term.One = fmt.Sprintf("JSON_CONTAINS(%s, ?, ?)", o.column())
+		term.Args = append(term.Args, path[0])
+	} else {
+		term.One = fmt.Sprintf("JSON_CONTAINS(%s, ?)", o.column())
+	}
+	return term
+}
 
 func op(o Opt, opFlag int8, value interface{}) (term Term) {
-	term.One = fmt.Sprintf("`%s`.%s", o.tableName, o.dbColumnName)
+	term.One = o.column()
 	term.Op = opFlag
-	if opt, ok := value.(Varchar); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Text); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Blob); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Tinyint); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Smallint); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Int); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Bigint); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Float); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Double); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Decimal); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Datetime); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
-	} else if opt, ok := value.(Bool); ok {
-		term.Other = fmt.Sprintf("`%s`.%s", opt.tableName, opt.dbColumnName)
+	if vs, ok := value.([]interface{}); ok && (opFlag == OpIn || opFlag == OpNotIn) {
+		signs := make([]string, len(vs))
+		for i := range vs {
+			signs[i] = "?"
+		}
+		term.Other = "(" + strings.Join(signs, ",") + ")"
+		args := make([]interface{}, len(vs))
+		for i, v := range vs {
+			args[i] = o.convert(v)
+		}
+		term.Value = args
+		return
+	}
+	if opt := getOpt(value); opt != nil {
+		term.Other = opt.column()
 	} else {
 		term.Other = "?"
-		term.Value = value
+		term.Value = o.convert(value)
 	}
 	return
 }
@@ -0,0 +1,420 @@
+package mdb
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestColumnSqlType(t *testing.T)  {
+	columns := map[string]Column{
+		"varchar": &Varchar{}, "text": &Text{}, "blob": &Blob{}, "tinyint": &Bool{},
+		"smallint": &Smallint{}, "int": &Int{}, "bigint": &Bigint{}, "float": &Float{},
+		"double": &Double{}, "decimal": &Decimal{}, "datetime": &Datetime{},
+		"char": &Char{}, "mediumtext": &MediumText{}, "longtext": &LongText{}, "binary": &Binary{},
+		"varbinary": &Varbinary{}, "mediumblob": &MediumBlob{}, "longblob": &LongBlob{},
+		"mediumint": &Mediumint{}, "year": &Year{}, "date": &Date{}, "time": &Time{}, "timestamp": &Timestamp{},
+		"tinyint unsigned": &Uint8{}, "smallint unsigned": &Uint16{}, "int unsigned": &Uint32{},
+		"bigint unsigned": &Uint64{}, "enum": &Enum{}, "set": &Set{}, "point": &Point{},
+		"binary(16)": &UUID{},
+	}
+	for sqlType, column := range columns {
+		if column.SqlType() != sqlType {
+			t.Errorf("expect %s, got %s", sqlType, column.SqlType())
+		}
+		if column.State() != StateUnset || column.IsNull() {
+			t.Errorf("%s zero value should be unset", sqlType)
+		}
+	}
+	var smallint Smallint
+	if err := smallint.Scan([]byte("888")); err != nil || smallint.V != 888 || smallint.Raw != int16(888) {
+		t.Fatalf("got %v %v", smallint, err)
+	}
+	if err := smallint.Scan(nil); err != nil || smallint.NotNul || smallint.Raw != nil {
+		t.Fatalf("got %v %v", smallint, err)
+	}
+}
+
+func TestColumnState(t *testing.T)  {
+	zero := NewInt(0)
+	if zero.State() != StateValue || zero.value() != int32(0) {
+		t.Fatalf("NewInt(0) should be value 0, got %v", zero.State())
+	}
+	null := Null[Int]()
+	if null.State() != StateNull || !null.IsNull() || null.value() != nil {
+		t.Fatalf("Null[Int]() should be null, got %v", null.State())
+	}
+	// 赋值后不再是 null
+	null.Set(3)
+	if null.State() != StateValue || null.V != 3 {
+		t.Fatalf("got %v %v", null.State(), null.V)
+	}
+	var unset Varchar
+	if unset.State() != StateUnset {
+		t.Fatalf("zero Varchar should be unset, got %v", unset.State())
+	}
+	if err := unset.Scan(nil); err != nil || unset.State() != StateNull {
+		t.Fatalf("scan nil should be null, got %v %v", unset.State(), err)
+	}
+	if err := unset.Scan([]byte("")); err != nil || unset.State() != StateValue {
+		t.Fatalf("scan empty string should be value, got %v %v", unset.State(), err)
+	}
+}
+
+func TestColumnScan(t *testing.T)  {
+	now := time.Date(2021, 5, 1, 8, 30, 0, 0, time.UTC)
+	// 不同的 driver 参数返回的类型不同，都需要能够转换
+	cases := []struct {
+		column Column
+		src    interface{}
+		want   interface{}
+	}{
+		{&Varchar{}, []byte("abc"), "abc"},
+		{&Varchar{}, "abc", "abc"},
+		{&Varchar{}, int64(12), "12"},
+		{&Blob{}, "abc", []byte("abc")},
+		{&Tinyint{}, int64(-8), int8(-8)},
+		{&Smallint{}, []byte("888"), int16(888)},
+		{&Int{}, float64(12), int32(12)},
+		{&Bigint{}, "9223372036854775807", int64(9223372036854775807)},
+		{&Float{}, []byte("1.5"), float32(1.5)},
+		{&Double{}, int64(3), float64(3)},
+		{&Decimal{}, []byte("3.14"), decimal.RequireFromString("3.14")},
+		{&Decimal{}, float64(3.5), decimal.RequireFromString("3.5")},
+		{&Datetime{}, now, now},
+		{&Datetime{}, []byte("2021-05-01 08:30:00"), now},
+		{&Bool{}, int64(1), true},
+		{&Bool{}, []byte("0"), false},
+		{&Char{}, []byte("ab"), "ab"},
+		{&LongText{}, "abc", "abc"},
+		{&Binary{}, []byte{1, 0, 0}, []byte{1, 0, 0}},
+		{&MediumBlob{}, []byte("abc"), []byte("abc")},
+		{&Mediumint{}, []byte("-8388608"), int32(-8388608)},
+		{&Year{}, int64(2021), int16(2021)},
+		{&Year{}, []byte("0000"), int16(0)},
+		{&Date{}, []byte("2021-05-01"), time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{&Timestamp{}, now, now},
+		{&Time{}, []byte("08:30:00"), 8*time.Hour + 30*time.Minute},
+		{&Time{}, []byte("-838:59:59.5"), -(838*time.Hour + 59*time.Minute + 59500*time.Millisecond)},
+		{&Uint8{}, int64(255), uint8(255)},
+		{&Uint16{}, []byte("65535"), uint16(65535)},
+		{&Uint32{}, float64(4294967295), uint32(4294967295)},
+		{&Uint64{}, uint64(18446744073709551615), uint64(18446744073709551615)},
+		{&Uint64{}, []byte("18446744073709551615"), uint64(18446744073709551615)},
+		{&Enum{}, []byte("active"), "active"},
+	}
+	for _, c := range cases {
+		if err := c.column.Scan(c.src); err != nil {
+			t.Errorf("scan %T(%v) into %T: %v", c.src, c.src, c.column, err)
+			continue
+		}
+		got := c.column.value()
+		switch want := c.want.(type) {
+		case decimal.Decimal:
+			if !want.Equal(got.(decimal.Decimal)) {
+				t.Errorf("scan %v: expect %v, got %v", c.src, want, got)
+			}
+		case []byte:
+			if string(want) != string(got.([]byte)) {
+				t.Errorf("scan %v: expect %v, got %v", c.src, want, got)
+			}
+		case time.Time:
+			if !want.Equal(got.(time.Time)) {
+				t.Errorf("scan %v: expect %v, got %v", c.src, want, got)
+			}
+		default:
+			if got != want {
+				t.Errorf("scan %T(%v) into %T: expect %v, got %v", c.src, c.src, c.column, want, got)
+			}
+		}
+	}
+	// 转换失败返回错误，而不是零值
+	failures := []struct {
+		column Column
+		src    interface{}
+	}{
+		{&Tinyint{}, int64(300)},
+		{&Int{}, []byte("abc")},
+		{&Int{}, float64(1.5)},
+		{&Decimal{}, []byte("abc")},
+		{&Datetime{}, []byte("abc")},
+		{&Bool{}, time.Now()},
+		{&Mediumint{}, int64(8388608)},
+		{&Year{}, int64(1900)},
+		{&Time{}, []byte("08:61:00")},
+		{&Uint8{}, int64(256)},
+		{&Uint16{}, int64(-1)},
+		{&Uint32{}, []byte("4294967296")},
+		{&Uint64{}, []byte("-1")},
+	}
+	for _, c := range failures {
+		if err := c.column.Scan(c.src); err == nil {
+			t.Errorf("scan %T(%v) into %T should fail", c.src, c.src, c.column)
+		}
+	}
+}
+
+func TestColumnValue(t *testing.T)  {
+	cases := []struct {
+		column driver.Valuer
+		want   driver.Value
+	}{
+		{Varchar{V: "abc"}, "abc"},
+		{Varchar{}, nil},
+		{Varchar{NotNul: true}, ""},
+		{Smallint{V: 888}, int64(888)},
+		{Float{V: 1.5}, float64(1.5)},
+		{Decimal{V: decimal.RequireFromString("3.14")}, "3.14"},
+		{Bool{V: true}, true},
+		{NewTime(-(12*time.Hour + 500*time.Millisecond)), "-12:00:00.5"},
+		{NewUint8(255), int64(255)},
+		{NewUint64(1 << 62), int64(1 << 62)},
+		{NewUint64(18446744073709551615), uint64(18446744073709551615)},
+	}
+	for _, c := range cases {
+		got, err := c.column.Value()
+		if err != nil || got != c.want {
+			t.Errorf("%T: expect %v, got %v %v", c.column, c.want, got, err)
+		}
+	}
+}
+
+type jsonColumns struct {
+	Varchar  Varchar
+	Text     Text
+	Blob     Blob
+	Tinyint  Tinyint
+	Smallint Smallint
+	Int      Int
+	Bigint   Bigint
+	Float    Float
+	Double   Double
+	Decimal  Decimal
+	Datetime Datetime
+	Bool     Bool
+	Unset    Int
+	Null     Int
+}
+
+func TestColumnJSON(t *testing.T)  {
+	columns := jsonColumns{
+		Varchar:  NewVarchar("振兴"),
+		Text:     NewText(""),
+		Blob:     NewBlob([]byte{0, 1, 2}),
+		Tinyint:  NewTinyint(0),
+		Smallint: NewSmallint(-888),
+		Int:      NewInt(2147483647),
+		Bigint:   NewBigint(9223372036854775807),
+		Float:    NewFloat(1.1),
+		Double:   NewDouble(3.1415926),
+		Decimal:  NewDecimal(decimal.RequireFromString("12345678901234567890.123456789")),
+		Datetime: NewDatetime(time.Date(2021, 5, 1, 8, 30, 0, 123000000, time.FixedZone("CST", 8*3600))),
+		Bool:     NewBool(false),
+		Null:     Null[Int](),
+	}
+	expect := `{"Varchar":"振兴","Text":"","Blob":"AAEC","Tinyint":0,"Smallint":-888,"Int":2147483647,` +
+		`"Bigint":9223372036854775807,"Float":1.1,"Double":3.1415926,"Decimal":"12345678901234567890.123456789",` +
+		`"Datetime":"2021-05-01T08:30:00.123+08:00","Bool":false,"Unset":null,"Null":null}`
+	data, err := json.Marshal(columns)
+	if err != nil || string(data) != expect {
+		t.Fatalf("got %s %v", data, err)
+	}
+	var decoded jsonColumns
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := json.Marshal(decoded)
+	if string(again) != expect {
+		t.Fatalf("round trip got %s", again)
+	}
+	if !decoded.Decimal.V.Equal(columns.Decimal.V) || !decoded.Datetime.V.Equal(columns.Datetime.V) {
+		t.Fatalf("got %v %v", decoded.Decimal.V, decoded.Datetime.V)
+	}
+	if decoded.Tinyint.State() != StateValue || decoded.Null.State() != StateNull {
+		t.Fatalf("got %v %v", decoded.Tinyint.State(), decoded.Null.State())
+	}
+	// 和 Scan 一样接受数据库的格式
+	err = json.Unmarshal([]byte(`{"Datetime":"2021-05-01 08:30:00","Int":"12","Bool":1,"Decimal":3.14}`), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Datetime.V.Equal(time.Date(2021, 5, 1, 8, 30, 0, 0, time.UTC)) || decoded.Int.V != 12 ||
+		!decoded.Bool.V || !decoded.Decimal.V.Equal(decimal.RequireFromString("3.14")) {
+		t.Fatalf("got %+v", decoded)
+	}
+	if err = json.Unmarshal([]byte(`{"Tinyint":300}`), &decoded); err == nil {
+		t.Fatal("overflow should fail")
+	}
+}
+
+func TestColumnJSONType(t *testing.T)  {
+	var settings JSON[ProfileSettings]
+	if settings.SqlType() != "json" || settings.State() != StateUnset {
+		t.Fatalf("got %s %v", settings.SqlType(), settings.State())
+	}
+	if err := settings.Scan([]byte(`{"theme":"dark","tags":["vip"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if settings.V.Theme != "dark" || len(settings.V.Tags) != 1 || settings.State() != StateValue {
+		t.Fatalf("got %+v", settings.V)
+	}
+	if value, err := settings.Value(); err != nil || value != `{"theme":"dark","tags":["vip"]}` {
+		t.Fatalf("got %v %v", value, err)
+	}
+	if err := settings.Scan([]byte("{")); err == nil {
+		t.Fatal("invalid json should fail")
+	}
+	// api 输出的是对象本身，而不是字符串
+	data, err := json.Marshal(NewJSON(map[string]int{"a": 1}))
+	if err != nil || string(data) != `{"a":1}` {
+		t.Fatalf("got %s %v", data, err)
+	}
+	if text, err := NewJSON([]int{1, 2}).MarshalText(); err != nil || string(text) != "[1,2]" {
+		t.Fatalf("got %s %v", text, err)
+	}
+	null := Null[JSON[ProfileSettings]]()
+	if value, _ := null.Value(); value != nil || !null.IsNull() {
+		t.Fatalf("got %v", value)
+	}
+}
+
+func TestColumnSet(t *testing.T)  {
+	var roles Set
+	if err := roles.Scan([]byte("read,write")); err != nil || len(roles.V) != 2 || roles.V[1] != "write" {
+		t.Fatalf("got %v %v", roles.V, err)
+	}
+	if err := roles.Scan([]byte("")); err != nil || len(roles.V) != 0 || roles.State() != StateValue {
+		t.Fatalf("empty set should be a value, got %v %v", roles.State(), err)
+	}
+	if value, _ := NewSet("read", "write").Value(); value != "read,write" {
+		t.Fatalf("got %v", value)
+	}
+	if data, _ := json.Marshal(NewSet("read")); string(data) != `["read"]` {
+		t.Fatalf("got %s", data)
+	}
+}
+
+func TestColumnPoint(t *testing.T)  {
+	var point Point
+	// mysql 内部格式：SRID + 小端 WKB
+	if err := point.Scan(pointValue(GeoPoint{Lat: 41.8, Lng: 123.4})); err != nil {
+		t.Fatal(err)
+	}
+	if point.V.Lat != 41.8 || point.V.Lng != 123.4 {
+		t.Fatalf("got %+v", point.V)
+	}
+	// 大端，不带 SRID
+	wkb := []byte{0, 0, 0, 0, 1}
+	wkb = binary.BigEndian.AppendUint64(wkb, math.Float64bits(-73.9))
+	wkb = binary.BigEndian.AppendUint64(wkb, math.Float64bits(40.7))
+	if err := point.Scan(wkb); err != nil || point.V.Lat != 40.7 || point.V.Lng != -73.9 {
+		t.Fatalf("got %+v %v", point.V, err)
+	}
+	if err := point.Scan([]byte{1, 2, 3}); err == nil {
+		t.Fatal("invalid wkb should fail")
+	}
+	value, err := NewPoint(41.8, 123.4).Value()
+	if b, ok := value.([]byte); err != nil || !ok || len(b) != 25 || binary.LittleEndian.Uint32(b) != SRID {
+		t.Fatalf("got %v %v", value, err)
+	}
+	data, err := json.Marshal(NewPoint(41.8, 123.4))
+	if err != nil || string(data) != `{"lat":41.8,"lng":123.4}` {
+		t.Fatalf("got %s %v", data, err)
+	}
+	if err = json.Unmarshal([]byte(`{"lat":1.5,"lng":2}`), &point); err != nil || point.V.Lat != 1.5 || point.V.Lng != 2 {
+		t.Fatalf("got %+v %v", point.V, err)
+	}
+	if text, _ := point.MarshalText(); string(text) != "1.5,2" {
+		t.Fatalf("got %s", text)
+	}
+	if err = point.UnmarshalText([]byte("41.8, 123.4")); err != nil || point.V.Lng != 123.4 {
+		t.Fatalf("got %+v %v", point.V, err)
+	}
+}
+
+func TestColumnUUID(t *testing.T)  {
+	id := "6ccd780c-baba-1026-9564-5b8c656024db"
+	u, err := ParseUUID(strings.ToUpper(id))
+	if err != nil || u.String() != id {
+		t.Fatalf("got %s %v", u, err)
+	}
+	if _, err = ParseUUID("6ccd780c-baba-1026-9564"); err == nil {
+		t.Fatal("short uuid should fail")
+	}
+	var column UUID
+	if err = column.Scan(u[:]); err != nil || column.V != u {
+		t.Fatalf("got %s %v", column.V, err)
+	}
+	// 和 UUID_TO_BIN(uuid, 1) 一致
+	ordered := NewOrderedUUID(u)
+	value, _ := ordered.Value()
+	if hex.EncodeToString(value.([]byte)) != "1026baba6ccd780c95645b8c656024db" {
+		t.Fatalf("got %x", value)
+	}
+	var scanned OrderedUUID
+	if err = scanned.Scan(value); err != nil || scanned.V != u {
+		t.Fatalf("got %s %v", scanned.V, err)
+	}
+	data, err := json.Marshal(ordered)
+	if err != nil || string(data) != `"`+id+`"` {
+		t.Fatalf("got %s %v", data, err)
+	}
+	if err = json.Unmarshal(data, &column); err != nil || column.V != u {
+		t.Fatalf("got %s %v", column.V, err)
+	}
+	if text, _ := column.MarshalText(); string(text) != id {
+		t.Fatalf("got %s", text)
+	}
+	v7 := UUIDv7()
+	if v7[6]>>4 != 7 || v7[8]>>6 != 2 || UUIDv7() == v7 {
+		t.Fatalf("got %s", v7)
+	}
+}
+
+func TestColumnText(t *testing.T)  {
+	cases := []struct {
+		column interface {
+			encoding.TextMarshaler
+			encoding.TextUnmarshaler
+		}
+		text string
+	}{
+		{&Varchar{}, "振兴"},
+		{&Blob{}, "abc"},
+		{&Tinyint{}, "-8"},
+		{&Int{}, "0"},
+		{&Bigint{}, "9223372036854775807"},
+		{&Float{}, "1.1"},
+		{&Double{}, "3.1415926"},
+		{&Decimal{}, "12345678901234567890.123456789"},
+		{&Datetime{}, "2021-05-01T08:30:00.123+08:00"},
+		{&Bool{}, "true"},
+		{&Date{}, "2021-05-01"},
+		{&Time{}, "100:00:01.000001"},
+		{&Uint64{}, "18446744073709551615"},
+	}
+	for _, c := range cases {
+		if err := c.column.UnmarshalText([]byte(c.text)); err != nil {
+			t.Errorf("%T: %v", c.column, err)
+			continue
+		}
+		if got, err := c.column.MarshalText(); err != nil || string(got) != c.text {
+			t.Errorf("%T: expect %s, got %s %v", c.column, c.text, got, err)
+		}
+	}
+	var unset Int
+	if text, _ := unset.MarshalText(); len(text) != 0 {
+		t.Fatalf("unset should be empty, got %s", text)
+	}
+	if err := unset.UnmarshalText(nil); err != nil || unset.State() != StateNull {
+		t.Fatalf("empty text should be null, got %v %v", unset.State(), err)
+	}
+}
@@ -0,0 +1,417 @@
+package mdb
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnitOfWork 工作单元：同一个主键只保留一个 model 实例（identity map），加载时记录快照，
+// Flush 时在一个事务中只写入修改过的列，INSERT UPDATE 按 belongs_to has_many 的依赖顺序，DELETE 相反
+// 不是并发安全的，一般一个请求使用一个
+type UnitOfWork struct {
+	sess     *Session                                  // 为 nil 时使用全局的 db，Flush 开启新的事务
+	identity map[reflect.Type]map[interface{}]*tracked // 主键经过 mapKey 转换
+	tracked  []*tracked                                // 注册的顺序，同一类型内按这个顺序执行
+}
+
+const (
+	trackedClean = iota
+	trackedNew
+	trackedDeleted
+)
+
+type tracked struct {
+	model    reflect.Value // 结构体指针
+	key      interface{}   // 主键的值，新增时可能为 nil
+	state    int
+	snapshot map[string]columnSnapshot
+}
+
+type columnSnapshot struct {
+	state State
+	value driver.Value
+}
+
+// NewUnitOfWork sess 不为 nil 时在其中加载，Flush 使用嵌套的 session
+func NewUnitOfWork(sess *Session) *UnitOfWork {
+	return &UnitOfWork{sess: sess, identity: make(map[reflect.Type]map[interface{}]*tracked)}
+}
+
+// Find 按主键获取 T，已经加载过的直接返回同一个实例，不存在时返回 nil
+func Find[T any](uow *UnitOfWork, id interface{}) (*T, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	key, err := identityKey(t, id)
+	if err != nil {
+		return nil, err
+	}
+	if tr, ok := uow.identity[t][mapKey(key)]; ok {
+		if tr.state == trackedDeleted {
+			return nil, nil
+		}
+		return tr.model.Interface().(*T), nil
+	}
+	var exec executor
+	if uow.sess != nil {
+		exec = uow.sess.exec
+	}
+	results, err := selectIn(exec, t, primaryKeyField(t), []interface{}{key})
+	if err != nil || results.Len() == 0 {
+		return nil, err
+	}
+	model := reflect.New(t)
+	model.Elem().Set(results.Index(0))
+	uow.track(model, trackedClean)
+	return model.Interface().(*T), nil
+}
+
+// identityKey 主键值转换为列的原始值，如 Int 的主键 1 转换为 int32(1)
+func identityKey(t reflect.Type, id interface{}) (interface{}, error) {
+	pk := primaryKeyField(t)
+	column := reflect.New(pk.typ).Interface().(Column)
+	if err := column.Scan(id); err != nil {
+		return nil, err
+	}
+	return column.value(), nil
+}
+
+// mapKey 主键作为 map 的 key，[]byte（Binary Varbinary）不能比较，转换为 string
+func mapKey(key interface{}) interface{} {
+	if b, ok := key.([]byte); ok {
+		return string(b)
+	}
+	return key
+}
+
+// Attach 注册在其他地方加载的 model，已经有同一主键的实例时返回已有的实例，之后应该使用返回值
+func (uow *UnitOfWork) Attach(model interface{}) interface{} {
+	value := uow.checkModel(model)
+	if tr, ok := uow.lookup(value); ok {
+		return tr.model.Interface()
+	}
+	uow.track(value, trackedClean)
+	return model
+}
+
+// Add 新增的 model，Flush 时 INSERT
+func (uow *UnitOfWork) Add(model interface{}) {
+	value := uow.checkModel(model)
+	if _, ok := uow.lookup(value); ok {
+		log.Panicf("UnitOfWork.Add: %T with the same primary key is already tracked!", model)
+	}
+	uow.track(value, trackedNew)
+}
+
+// Remove 删除已经加载或者新增的 model，Flush 时 DELETE；新增还没有 Flush 的直接丢弃
+func (uow *UnitOfWork) Remove(model interface{}) {
+	value := uow.checkModel(model)
+	for i, tr := range uow.tracked {
+		if tr.model.Pointer() != value.Pointer() {
+			continue
+		}
+		if tr.state == trackedNew {
+			uow.untrack(i)
+		} else {
+			tr.state = trackedDeleted
+		}
+		return
+	}
+	log.Panicf("UnitOfWork.Remove: %T is not tracked!", model)
+}
+
+func (uow *UnitOfWork) checkModel(model interface{}) reflect.Value {
+	value := reflect.ValueOf(model)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		log.Panicf("UnitOfWork: %T must be a pointer to struct!", model)
+	}
+	primaryKeyField(value.Type())
+	return value
+}
+
+func (uow *UnitOfWork) lookup(model reflect.Value) (*tracked, bool) {
+	key := primaryKeyField(model.Type()).value(model.Elem())
+	if key == nil {
+		return nil, false
+	}
+	tr, ok := uow.identity[model.Type().Elem()][mapKey(key)]
+	return tr, ok
+}
+
+func (uow *UnitOfWork) track(model reflect.Value, state int) {
+	tr := &tracked{model: model, state: state}
+	tr.snap()
+	uow.tracked = append(uow.tracked, tr)
+	uow.index(tr)
+}
+
+// index 按主键放入 identity map，主键为空的不放入
+func (uow *UnitOfWork) index(tr *tracked) {
+	t := tr.model.Type().Elem()
+	tr.key = primaryKeyField(t).value(tr.model.Elem())
+	if tr.key == nil {
+		return
+	}
+	if uow.identity[t] == nil {
+		uow.identity[t] = make(map[interface{}]*tracked)
+	}
+	uow.identity[t][mapKey(tr.key)] = tr
+}
+
+func (uow *UnitOfWork) untrack(i int) {
+	tr := uow.tracked[i]
+	if key := mapKey(tr.key); tr.key != nil && uow.identity[tr.model.Type().Elem()][key] == tr {
+		delete(uow.identity[tr.model.Type().Elem()], key)
+	}
+	uow.tracked = append(uow.tracked[:i], uow.tracked[i+1:]...)
+}
+
+// snap 记录所有列的状态和值
+func (tr *tracked) snap() {
+	meta := getModelMeta(tr.model.Type())
+	tr.snapshot = make(map[string]columnSnapshot, len(meta.fields))
+	for _, field := range meta.fields {
+		if !field.isColumn() {
+			continue
+		}
+		column := field.columnOf(tr.model.Elem())
+		value, _ := column.Value()
+		tr.snapshot[field.column] = columnSnapshot{state: column.State(), value: value}
+	}
+}
+
+// changes 和快照相比修改过的列；设置为 unset 的列忽略
+func (tr *tracked) changes() (fields []insertField, err error) {
+	meta := getModelMeta(tr.model.Type())
+	for _, field := range meta.fields {
+		if !field.isColumn() {
+			continue
+		}
+		column := field.columnOf(tr.model.Elem())
+		if column.State() == StateUnset {
+			continue
+		}
+		value, err := column.Value()
+		if err == nil {
+			err = field.validate(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		old := tr.snapshot[field.column]
+		if old.state == column.State() && sameValue(old.value, value) {
+			continue
+		}
+		if field == meta.primaryKey && old.state != StateUnset {
+			return nil, fmt.Errorf("mdb: primary key %s.%s can not be changed", meta.tableName, field.name)
+		}
+		fields = append(fields, insertField{columnName: field.column, value: value})
+	}
+	return fields, nil
+}
+
+func sameValue(a, b driver.Value) bool {
+	switch va := a.(type) {
+	case time.Time:
+		vb, ok := b.(time.Time)
+		return ok && va.Equal(vb)
+	case []byte:
+		vb, ok := b.([]byte)
+		return ok && bytes.Equal(va, vb) && (va == nil) == (vb == nil)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Dirty 是否有需要 Flush 的修改
+func (uow *UnitOfWork) Dirty() bool {
+	for _, tr := range uow.tracked {
+		if tr.state != trackedClean {
+			return true
+		}
+		if fields, err := tr.changes(); err != nil || len(fields) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush 在一个事务中写入所有修改，成功后更新快照；失败时事务回滚，快照不变，可以修正后再次 Flush
+// 新增的 model 主键为空时生成（UUID）或插入后写回（auto_increment），失败时恢复为空
+func (uow *UnitOfWork) Flush() error {
+	if !uow.Dirty() {
+		return nil
+	}
+	keys := make(map[*tracked]reflect.Value)
+	for _, tr := range uow.tracked {
+		if tr.state == trackedNew {
+			pk := tr.model.Elem().FieldByIndex(primaryKeyField(tr.model.Type()).index)
+			keys[tr] = reflect.New(pk.Type()).Elem()
+			keys[tr].Set(pk)
+		}
+	}
+	err := uow.sess.ObtainSession(Write, uow.flush)
+	if err != nil {
+		for tr, key := range keys {
+			tr.model.Elem().FieldByIndex(primaryKeyField(tr.model.Type()).index).Set(key)
+		}
+		return err
+	}
+	for i := len(uow.tracked) - 1; i >= 0; i-- {
+		tr := uow.tracked[i]
+		if tr.state == trackedDeleted {
+			uow.untrack(i)
+			continue
+		}
+		tr.state = trackedClean
+		tr.snap()
+		uow.index(tr)
+	}
+	return nil
+}
+
+func (uow *UnitOfWork) flush(sess *Session) error {
+	order := uow.typeOrder()
+	// 新增和修改：被依赖的表在前
+	for _, t := range order {
+		for _, tr := range uow.tracked {
+			if tr.model.Type().Elem() != t || tr.state == trackedDeleted {
+				continue
+			}
+			if tr.state == trackedNew {
+				if err := tr.insert(sess); err != nil {
+					return err
+				}
+				continue
+			}
+			fields, err := tr.changes()
+			if err != nil {
+				return err
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			if tr.key == nil {
+				return fmt.Errorf("mdb: %s has no primary key, can not update", tableName(t))
+			}
+			sqlBuilder := sess.Model(tr.model.Interface())
+			sqlBuilder.InsertFields = fields
+			result, err := sqlBuilder.Where(tr.keyTerm()).update()
+			if err = tr.checkAffected(sess, result, err); err != nil {
+				return err
+			}
+		}
+	}
+	// 删除：依赖别的表的在前
+	for i := len(order) - 1; i >= 0; i-- {
+		for _, tr := range uow.tracked {
+			if tr.model.Type().Elem() != order[i] || tr.state != trackedDeleted {
+				continue
+			}
+			if tr.key == nil {
+				return fmt.Errorf("mdb: %s has no primary key, can not delete", tableName(order[i]))
+			}
+			result, err := sess.Model(tr.model.Interface()).Where(tr.keyTerm()).delete()
+			if err = tr.checkAffected(sess, result, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insert 主键为空时先生成，auto_increment 的插入后写回
+func (tr *tracked) insert(sess *Session) (err error) {
+	meta := getModelMeta(tr.model.Type())
+	pk := meta.primaryKey.columnOf(tr.model.Elem())
+	autoKey := false
+	if pk.State() != StateValue {
+		if autoKey, err = generateKey(meta, tr.model.Elem()); err != nil {
+			return err
+		}
+	}
+	result, err := sess.Model(tr.model.Interface()).insert()
+	if err != nil || !autoKey {
+		return err
+	}
+	return setInsertId(pk, result)
+}
+
+// checkAffected 按主键 UPDATE DELETE 没有影响行时返回错误，如已经被别处删除，避免修改静默丢失；
+// DSN 没有设置 clientFoundRows 时 MySQL 返回修改的行数，写入相同的值（如被截断的时间精度）也是 0，按主键确认行是否存在
+func (tr *tracked) checkAffected(sess *Session, result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 0 {
+		return err
+	}
+	t := tr.model.Type().Elem()
+	rows, err := selectIn(sess.exec, t, primaryKeyField(t), []interface{}{tr.key})
+	if err != nil {
+		return err
+	}
+	if rows.Len() == 0 {
+		return fmt.Errorf("mdb: %s %v matched no rows", tableName(t), tr.key)
+	}
+	return nil
+}
+
+// keyTerm 加载时的主键作为条件
+func (tr *tracked) keyTerm() Term {
+	opt := primaryKeyField(tr.model.Type()).opt(tr.model.Elem())
+	return opt.Eq(tr.key)
+}
+
+// typeOrder 涉及的类型按依赖排序：belongs_to 的表和 has_many 的 owner 在前；有环时按注册的顺序
+func (uow *UnitOfWork) typeOrder() []reflect.Type {
+	var types []reflect.Type
+	seen := make(map[reflect.Type]bool)
+	for _, tr := range uow.tracked {
+		if t := tr.model.Type().Elem(); !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	deps := make(map[reflect.Type][]reflect.Type)
+	for _, t := range types {
+		for _, rel := range getModelMeta(t).relations {
+			switch {
+			case rel.kind == BelongsTo && seen[rel.relType] && rel.relType != t:
+				deps[t] = append(deps[t], rel.relType)
+			case rel.kind == HasMany && seen[rel.relType] && rel.relType != t:
+				deps[rel.relType] = append(deps[rel.relType], t)
+			}
+		}
+	}
+	position := make(map[reflect.Type]int, len(types))
+	for i, t := range types {
+		position[t] = i
+	}
+	for _, ts := range deps {
+		sort.Slice(ts, func(i, j int) bool { return position[ts[i]] < position[ts[j]] })
+	}
+	var order []reflect.Type
+	visited := make(map[reflect.Type]int) // 1 访问中 2 完成
+	var visit func(t reflect.Type)
+	visit = func(t reflect.Type) {
+		if visited[t] != 0 {
+			return // 完成的或者有环
+		}
+		visited[t] = 1
+		for _, dep := range deps[t] {
+			visit(dep)
+		}
+		visited[t] = 2
+		order = append(order, t)
+	}
+	for _, t := range types {
+		visit(t)
+	}
+	return order
+}
@@ -0,0 +1,219 @@
+package mdb
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func studentRows(l *fakeLog) {
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"id", "name", "class_id", "score", "create_time", "state"},
+			[][]driver.Value{{[]byte("1"), []byte("Tom"), []byte("c1"), []byte("3.14"), time.Now(), int64(1)}}
+	}
+}
+
+func TestUnitOfWorkFind(t *testing.T) {
+	l := useFakeDb(t)
+	studentRows(l)
+	uow := NewUnitOfWork(nil)
+	stu, err := Find[Student](uow, "1")
+	if err != nil || stu == nil {
+		t.Fatalf("stu = %v, err = %v", stu, err)
+	}
+	again, _ := Find[Student](uow, "1")
+	if again != stu {
+		t.Error("Find the same primary key should return the same instance")
+	}
+	assertStmts(t, l, "SELECT")
+	if uow.Attach(&Student{ID: NewVarchar("1")}) != stu {
+		t.Error("Attach should return the tracked instance")
+	}
+	if uow.Dirty() {
+		t.Error("loaded model should not be dirty")
+	}
+
+	// 只更新修改过的列，成功后快照更新
+	stu.Name = NewVarchar("Jerry")
+	if err = uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "SELECT", "BEGIN", "UPDATE student SET student.name=? where", "COMMIT")
+	if got := l.all()[2]; strings.Contains(got, "class_id") || strings.Contains(got, "score") {
+		t.Errorf("update = %s, should only set name", got)
+	}
+	l.stmts = nil
+	if err = uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l)
+
+	stu.ID = NewVarchar("2")
+	if err = uow.Flush(); err == nil {
+		t.Error("changing primary key should fail")
+	}
+}
+
+func TestUnitOfWorkFlushFailed(t *testing.T) {
+	l := useFakeDb(t)
+	studentRows(l)
+	uow := NewUnitOfWork(nil)
+	stu, _ := Find[Student](uow, "1")
+	stu.Name = NewVarchar("Jerry")
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "UPDATE") {
+			return errors.New("lock wait timeout")
+		}
+		return nil
+	}
+	if err := uow.Flush(); err == nil {
+		t.Fatal("flush should fail")
+	}
+	// 失败后快照不变，再次 Flush 执行同样的修改
+	l.stmts, l.fail = nil, nil
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "UPDATE student SET student.name=?", "COMMIT")
+}
+
+// TestUnitOfWorkUnchanged UPDATE 写入相同的值时 MySQL 返回 0 行，行存在时不算失败
+func TestUnitOfWorkUnchanged(t *testing.T) {
+	l := useFakeDb(t)
+	studentRows(l)
+	uow := NewUnitOfWork(nil)
+	stu, _ := Find[Student](uow, "1")
+	stu.Name = NewVarchar("Jerry")
+	l.result = func(stmt string) driver.Result { return driver.RowsAffected(0) }
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "SELECT", "BEGIN", "UPDATE student SET student.name=?", "SELECT", "COMMIT")
+}
+
+func TestUnitOfWorkOrder(t *testing.T) {
+	l := useFakeDb(t)
+	uow := NewUnitOfWork(nil)
+	stu := &Student{ID: NewVarchar("1"), Name: NewVarchar("Tom"), ClassId: NewVarchar("c1")}
+	class := &Class{ID: NewVarchar("c1"), SchoolId: NewVarchar("s1")}
+	uow.Add(stu)
+	uow.Add(class)
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "INSERT INTO class", "INSERT INTO student", "COMMIT")
+	if found, _ := Find[Class](uow, "c1"); found != class {
+		t.Error("added model should be tracked after flush")
+	}
+
+	l.stmts = nil
+	uow.Remove(class)
+	uow.Remove(stu)
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "DELETE FROM student", "DELETE FROM class", "COMMIT")
+	if found, _ := Find[Student](uow, "1"); found != nil || len(l.all()) != 5 {
+		t.Error("removed model should be loaded again")
+	}
+
+	// 新增后删除的不执行
+	l.stmts = nil
+	uow.Add(stu)
+	uow.Remove(stu)
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l)
+
+	defer func() {
+		if p := recover(); p == nil {
+			t.Error("Add the same primary key twice should panic")
+		}
+	}()
+	uow.Add(class)
+	uow.Add(&Class{ID: NewVarchar("c1")})
+}
+
+// TestUnitOfWorkGeneratedKey 自增的主键插入后写回，之后按主键更新；没有影响行时 Flush 失败
+func TestUnitOfWorkGeneratedKey(t *testing.T) {
+	l := useFakeDb(t)
+	l.result = func(stmt string) driver.Result { return savedResult{id: 42, affected: 1} }
+	uow := NewUnitOfWork(nil)
+	comment := &Comment{StudentId: NewVarchar("1"), Content: NewText("hello")}
+	uow.Add(comment)
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if comment.ID.V != 42 {
+		t.Fatalf("id = %v, want 42", comment.ID.V)
+	}
+	if found, _ := Find[Comment](uow, int64(42)); found != comment {
+		t.Error("inserted model should be tracked by the generated key")
+	}
+
+	l.stmts = nil
+	comment.Content = NewText("world")
+	if err := uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "BEGIN", "UPDATE comment SET comment.content=?", "COMMIT")
+
+	l.result = func(stmt string) driver.Result { return savedResult{} }
+	comment.Content = NewText("again")
+	if err := uow.Flush(); err == nil {
+		t.Error("update matching no rows should fail")
+	}
+	uow.Remove(comment)
+	if err := uow.Flush(); err == nil {
+		t.Error("delete matching no rows should fail")
+	}
+
+	// 失败时生成的主键恢复为空
+	l.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "INSERT") {
+			return errors.New("duplicate entry")
+		}
+		return nil
+	}
+	device := &Device{Name: NewVarchar("d1")}
+	uow.Add(device)
+	if err := uow.Flush(); err == nil {
+		t.Fatal("flush should fail")
+	}
+	if device.ID.State() != StateUnset {
+		t.Errorf("id = %v, should be unset after failure", device.ID.V)
+	}
+}
+
+type blob struct {
+	ID   Binary  `mdb:"length:16 primary key"`
+	Name Varchar `mdb:"length:45"`
+}
+
+// TestUnitOfWorkBinaryKey []byte 的主键
+func TestUnitOfWorkBinaryKey(t *testing.T) {
+	l := useFakeDb(t)
+	l.rows = func(stmt string) ([]string, [][]driver.Value) {
+		return []string{"id", "name"}, [][]driver.Value{{[]byte{1, 2}, []byte("a")}}
+	}
+	uow := NewUnitOfWork(nil)
+	found, err := Find[blob](uow, []byte{1, 2})
+	if err != nil || found == nil {
+		t.Fatalf("found = %v, err = %v", found, err)
+	}
+	if again, _ := Find[blob](uow, []byte{1, 2}); again != found {
+		t.Error("Find the same binary key should return the same instance")
+	}
+	if uow.Attach(&blob{ID: NewBinary([]byte{1, 2})}) != found {
+		t.Error("Attach should return the tracked instance")
+	}
+	uow.Add(&blob{ID: NewBinary([]byte{3}), Name: NewVarchar("b")})
+	found.Name = NewVarchar("c")
+	if err = uow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertStmts(t, l, "SELECT", "BEGIN", "UPDATE blob SET blob.name=?", "INSERT INTO blob", "COMMIT")
+}
@@ -0,0 +1,144 @@
+package mdb
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UUIDValue UUID 列的值，16 个字节，字符串形式为 8-4-4-4-12
+type UUIDValue [16]byte
+
+// ParseUUID 解析 8-4-4-4-12 或者 32 位的十六进制字符串，不区分大小写
+func ParseUUID(s string) (UUIDValue, error) {
+	var u UUIDValue
+	h := strings.Replace(strings.TrimSpace(s), "-", "", -1)
+	if len(h) != 32 {
+		return u, fmt.Errorf("mdb: invalid uuid %q", s)
+	}
+	if _, err := hex.Decode(u[:], []byte(h)); err != nil {
+		return u, fmt.Errorf("mdb: invalid uuid %q", s)
+	}
+	return u, nil
+}
+
+// UUIDv7 生成 v7 的 uuid，前 48 位为毫秒时间戳，按生成顺序递增，适合作为主键
+func UUIDv7() UUIDValue {
+	var u UUIDValue
+	_, _ = rand.Read(u[6:])
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(u[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(u[2:6], uint32(ms))
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+	return u
+}
+
+func (u UUIDValue) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// MarshalText json 和文本中都是字符串形式
+func (u UUIDValue) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+func (u *UUIDValue) UnmarshalText(text []byte) error {
+	v, err := ParseUUID(string(text))
+	if err != nil {
+		return err
+	}
+	*u = v
+	return nil
+}
+
+// Value 直接作为参数时是不交换字节的 16 个字节
+func (u UUIDValue) Value() (driver.Value, error) {
+	return u[:], nil
+}
+
+// swapUUID 等同 mysql 的 UUID_TO_BIN(uuid, 1)：time-high 和 time-low 交换，v1 的 uuid 因此按时间递增
+func swapUUID(u UUIDValue) UUIDValue {
+	var s UUIDValue
+	copy(s[0:2], u[6:8])
+	copy(s[2:4], u[4:6])
+	copy(s[4:8], u[0:4])
+	copy(s[8:], u[8:])
+	return s
+}
+
+// unswapUUID 等同 BIN_TO_UUID(bin, 1)
+func unswapUUID(s UUIDValue) UUIDValue {
+	var u UUIDValue
+	copy(u[0:4], s[4:8])
+	copy(u[4:6], s[2:4])
+	copy(u[6:8], s[0:2])
+	copy(u[8:], s[8:])
+	return u
+}
+
+// asUUID driver 返回 16 个字节，也接受字符串形式
+func asUUID(src interface{}) (UUIDValue, error) {
+	switch v := src.(type) {
+	case UUIDValue:
+		return v, nil
+	case []byte:
+		if len(v) == 16 {
+			var u UUIDValue
+			copy(u[:], v)
+			return u, nil
+		}
+		if u, err := ParseUUID(string(v)); err == nil {
+			return u, nil
+		}
+	case string:
+		if u, err := ParseUUID(v); err == nil {
+			return u, nil
+		}
+	}
+	return UUIDValue{}, errConvert(src, "uuid")
+}
+
+// uuidKind binary(16) 存储，Term 中的字符串会被转换
+type uuidKind struct{}
+
+func (uuidKind) SqlType() string                            { return "binary(16)" }
+func (uuidKind) Convert(src interface{}) (UUIDValue, error) { return asUUID(src) }
+func (uuidKind) Value(v UUIDValue) (driver.Value, error)    { return v[:], nil }
+
+// Arg 无法转换的值原样返回，比如非法的 uuid 字符串，这样只是查询不到
+func (uuidKind) Arg(v interface{}) interface{} {
+	if u, err := asUUID(v); err == nil {
+		return u[:]
+	}
+	return v
+}
+
+// orderedUUIDKind 存储时交换字节，和 UUID_TO_BIN(uuid, 1) BIN_TO_UUID(bin, 1) 兼容
+// 适用于 v1 的 uuid；v7 本身就按时间递增，使用 UUID 即可
+type orderedUUIDKind struct{}
+
+func (orderedUUIDKind) SqlType() string { return "binary(16)" }
+func (orderedUUIDKind) Convert(src interface{}) (UUIDValue, error) {
+	if b, ok := src.([]byte); ok && len(b) == 16 {
+		u, _ := asUUID(b)
+		return unswapUUID(u), nil
+	}
+	return asUUID(src)
+}
+func (orderedUUIDKind) Value(v UUIDValue) (driver.Value, error) {
+	s := swapUUID(v)
+	return s[:], nil
+}
+func (orderedUUIDKind) Arg(v interface{}) interface{} {
+	if u, err := asUUID(v); err == nil {
+		s := swapUUID(u)
+		return s[:]
+	}
+	return v
+}
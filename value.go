@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"strings"
 )
 
 //var _scannerInterface = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
@@ -19,7 +18,7 @@ func scanAll(sqlBuilder *SqlBuilder, dests ...interface{}) error {
 	}
 	// 执行sql 语句
 	var rows *sql.Rows
-	rows, err = db.Query(sqlBuilder.SqlStmt, sqlBuilder.Values...)
+	rows, err = sqlBuilder.executor().Query(sqlBuilder.SqlStmt, sqlBuilder.Values...)
 	if err != nil {
 		return err
 	}
@@ -32,42 +31,48 @@ func scanAll(sqlBuilder *SqlBuilder, dests ...interface{}) error {
 		return err
 	}
 	values := make([]interface{}, len(columns)) // 和 fieldset 一致
+	var rowCount int
 	for rows.Next() {
-		sliceMap := locateScanValues(destCatch, values, sqlBuilder.SelectFields)
+		// 游标分页多取了一行，存在说明有下一页，这一行不返回
+		if sqlBuilder.cursor != nil && rowCount == sqlBuilder.limit {
+			sqlBuilder.recordCursor(values)
+			break
+		}
+		instMap := locateScanValues(destCatch, values, sqlBuilder.SelectFields)
 		err = rows.Scan(values...)
 		if err != nil {
 			return err
 		}
-		for slice, obj := range sliceMap {
+		rowCount++
+		// 合并 join 的重复行
+		if sqlBuilder.collapse != nil {
+			sqlBuilder.collapse.add(sqlBuilder.MainTable, destCatch, instMap)
+			continue
+		}
+		for tableName, obj := range instMap {
+			slice := destCatch[tableName].slice
 			slice.Set(reflect.Append(slice, obj))
 		}
 	}
-	return err
+	return rows.Err()
 }
 
-// locateScanValues 获取scan 的参数地址
+// locateScanValues 获取scan 的参数地址，返回 表名 -> 本行的 obj
 func locateScanValues(destCatch map[string]destCell, values []interface{},
-	fields []selectField) map[reflect.Value]reflect.Value {
+	fields []selectField) map[string]reflect.Value {
 	instMap := make(map[string]reflect.Value)
-	sliceMap := make(map[reflect.Value]reflect.Value)
 	for tableName, cell := range destCatch {
 		vp := reflect.New(cell.baseStruct)
 		v := reflect.Indirect(vp)
 		instMap[tableName] = v
-		sliceMap[cell.slice] = v
 	}
 	// 这里存在不同的表，将上面对应的 obj 缓存起来了。一个row.next 只有一组obj生成
 	for i, field := range fields {
 		obj := instMap[field.tableName]
-		// 这里不用校验，checkDest 开始就校验了
-		attr := obj.FieldByName(field.orgColumnName)
-		//attr = attr.FieldByName("V")
-		alloc := reflect.New(Deref(attr.Type()))
-		alloc = reflect.Indirect(alloc)
-		attr.Set(alloc)
-		values[i] = attr.Addr().Interface()
+		// 这里不用校验，checkDest 开始就校验了，并且缓存了字段的 index；obj 是新建的不需要再初始化
+		values[i] = obj.FieldByIndex(field.index).Addr().Interface()
 	}
-	return sliceMap
+	return instMap
 }
 
 type destCell struct {
@@ -99,16 +104,19 @@ func checkDest(fields []selectField, dests ...interface{}) (error, map[string]de
 		}
 		// 这就是返回的slice
 		cell.slice = reflect.Indirect(value)
-		_array := strings.Split(cell.baseStruct.String(), ".")
-		tableName := UnMarshal4Camel(_array[len(_array)-1])
-		destCatch[tableName] = cell
+		destCatch[getModelMeta(cell.baseStruct).tableName] = cell
 	}
-	// 解析dest，判断是否包含对应的field字段
-	for _, field := range fields {
+	// 解析dest，判断是否包含对应的field字段，并记录字段的 index
+	for i, field := range fields {
+		if _, ok := destCatch[field.tableName]; !ok {
+			return fmt.Errorf("dest of table %s is missing", field.tableName), nil
+		}
 		baseStruct := destCatch[field.tableName].baseStruct
-		if _, found := baseStruct.FieldByName(Marshal2Camel(field.columnName)); !found {
+		fieldMeta, found := getModelMeta(baseStruct).byName[field.orgColumnName]
+		if !found {
 			return fmt.Errorf("dest %T do not has the feild %s", baseStruct, field.columnName), nil
 		}
+		fields[i].index = fieldMeta.index
 	}
 	return nil, destCatch
 }
@@ -0,0 +1,428 @@
+package mdb
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// DealXA 每个分支一个 Session，key 为 NewXA 时的分支名
+type DealXA func(sessions map[string]*Session) error
+
+// XADecisionLog 本地持久化的提交决定；写入 commit 之后才会 XA COMMIT，没有记录的分支恢复时回滚
+type XADecisionLog interface {
+	// Node 实例的标识，作为 gtrid 的前缀，Recover 只处理这个前缀的分支；重启后需要保持不变，只能包含字母数字 _
+	Node() string
+	// Commit 持久化提交的决定，返回 nil 之后事务必须提交
+	Commit(xid string, branches []string) error
+	Committed(xid string) (bool, error)
+	// Forget 所有分支都已经提交，不再需要记录
+	Forget(xid string) error
+	// Pending 已经决定提交但是还没有 Forget 的 xid
+	Pending() ([]string, error)
+}
+
+// XA 跨多个 mysql 的分布式事务，不需要外部的协调者；由本地的 XADecisionLog 记录决定
+type XA struct {
+	dbs      map[string]*sql.DB
+	decision XADecisionLog
+	mu       sync.Mutex
+	active   map[string]bool // 执行中的 xid，恢复时跳过
+}
+
+// xaPrefix 本库生成的 gtrid 的前缀，后面是 decision log 的 Node
+const xaPrefix = "mdb-"
+
+var xaBranchName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+var xaNodeName = regexp.MustCompile(`^[A-Za-z0-9_]{1,16}$`)
+
+// NewXA dbs 的 key 为分支名，同时作为 XA 的 bqual，只能包含字母数字 _ -
+func NewXA(decision XADecisionLog, dbs map[string]*sql.DB) *XA {
+	if decision == nil || len(dbs) == 0 {
+		log.Panic("NewXA: need decision log and dbs!")
+	}
+	for name := range dbs {
+		if !xaBranchName.MatchString(name) {
+			log.Panicf("NewXA: invalid branch name %q!", name)
+		}
+	}
+	if !xaNodeName.MatchString(decision.Node()) {
+		log.Panicf("NewXA: invalid decision log node %q!", decision.Node())
+	}
+	return &XA{dbs: dbs, decision: decision, active: map[string]bool{}}
+}
+
+// xaConn XA 分支固定使用一个连接
+type xaConn struct {
+	conn *sql.Conn
+}
+
+func (c xaConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (c xaConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (c xaConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+type xaBranch struct {
+	name  string
+	conn  xaConn
+	state string // active prepared committed
+}
+
+// prefix 本实例的 gtrid 前缀，多个实例共用 mysql 时 Recover 不会处理其他实例的分支
+func (xa *XA) prefix() string {
+	return xaPrefix + xa.decision.Node() + "-"
+}
+
+func xid(gtrid, bqual string) string {
+	return fmt.Sprintf("'%s','%s'", gtrid, bqual)
+}
+
+// Run 在所有分支上 XA START 后执行 deal；成功时 XA PREPARE 所有分支，写入提交的决定后 XA COMMIT
+// deal 返回错误、panic 或者有分支 PREPARE 失败时回滚所有分支，panic 会继续抛出
+// 决定提交后 XA COMMIT 失败的分支保持 prepared，返回错误，由 Recover 提交
+func (xa *XA) Run(deal DealXA) (err error) {
+	id := UUIDv7()
+	gtrid := xa.prefix() + hex.EncodeToString(id[:])
+	xa.mu.Lock()
+	xa.active[gtrid] = true
+	xa.mu.Unlock()
+	defer func() {
+		xa.mu.Lock()
+		delete(xa.active, gtrid)
+		xa.mu.Unlock()
+	}()
+
+	names := make([]string, 0, len(xa.dbs))
+	for name := range xa.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	branches := make([]*xaBranch, 0, len(names))
+	defer func() {
+		for _, b := range branches {
+			_ = b.conn.conn.Close()
+		}
+	}()
+	sessions := map[string]*Session{}
+	for _, name := range names {
+		conn, err := xa.dbs[name].Conn(context.Background())
+		if err != nil {
+			xaRollback(gtrid, branches)
+			return err
+		}
+		b := &xaBranch{name: name, conn: xaConn{conn}}
+		if _, err = b.conn.Exec("XA START " + xid(gtrid, name)); err != nil {
+			_ = conn.Close()
+			xaRollback(gtrid, branches)
+			return err
+		}
+		b.state = "active"
+		branches = append(branches, b)
+		sessions[name] = &Session{Read: sqlx.NewDb(xa.dbs[name], "mysql"), exec: b.conn, xa: true, Attempt: 1}
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			xaRollback(gtrid, branches)
+			panic(p)
+		}
+	}()
+	if err = deal(sessions); err != nil {
+		xaRollback(gtrid, branches)
+		return err
+	}
+
+	for _, b := range branches {
+		if _, err = b.conn.Exec("XA END " + xid(gtrid, b.name)); err != nil {
+			xaRollback(gtrid, branches)
+			return err
+		}
+		b.state = "idle"
+	}
+	if len(branches) == 1 {
+		// 只有一个分支时不需要两阶段
+		_, err = branches[0].conn.Exec("XA COMMIT " + xid(gtrid, branches[0].name) + " ONE PHASE")
+		return err
+	}
+	for _, b := range branches {
+		if _, err = b.conn.Exec("XA PREPARE " + xid(gtrid, b.name)); err != nil {
+			xaRollback(gtrid, branches)
+			return fmt.Errorf("mdb: xa %s prepare %s failed: %w", gtrid, b.name, err)
+		}
+		b.state = "prepared"
+	}
+
+	// 提交点：决定写入成功之后，所有分支最终都会提交
+	if err = xa.decision.Commit(gtrid, names); err != nil {
+		xaRollback(gtrid, branches)
+		return err
+	}
+	var failed []string
+	for _, b := range branches {
+		if _, err := b.conn.Exec("XA COMMIT " + xid(gtrid, b.name)); err != nil {
+			log.Warningf("xa %s commit %s failed, need Recover, err:%v\n", gtrid, b.name, err)
+			failed = append(failed, b.name)
+			continue
+		}
+		b.state = "committed"
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("mdb: xa %s committed, branches %s pending Recover", gtrid, strings.Join(failed, ","))
+	}
+	return xa.decision.Forget(gtrid)
+}
+
+// xaRollback 回滚还没有提交的分支，错误只记录日志
+func xaRollback(gtrid string, branches []*xaBranch) {
+	for _, b := range branches {
+		x := xid(gtrid, b.name)
+		if b.state == "active" {
+			if _, err := b.conn.Exec("XA END " + x); err != nil {
+				log.Warningf("xa %s end %s failed, err:%v\n", gtrid, b.name, err)
+			}
+		}
+		if b.state == "committed" {
+			continue
+		}
+		if _, err := b.conn.Exec("XA ROLLBACK " + x); err != nil {
+			log.Warningf("xa %s rollback %s failed, err:%v\n", gtrid, b.name, err)
+		}
+	}
+}
+
+// Recover 处理 XA RECOVER 中本实例（同一个 Node）生成的 prepared 分支：有提交决定的 XA COMMIT，没有的 XA ROLLBACK
+// 所有分支都提交之后 Forget；一般在启动时调用，执行中的 Run 的分支会被跳过
+func (xa *XA) Recover() error {
+	var errs []string
+	inDoubt := map[string]bool{}
+	names := make([]string, 0, len(xa.dbs))
+	for name := range xa.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		xids, err := xaRecover(xa.dbs[name], xa.prefix())
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		for _, x := range xids {
+			xa.mu.Lock()
+			active := xa.active[x[0]]
+			xa.mu.Unlock()
+			if active {
+				continue
+			}
+			committed, err := xa.decision.Committed(x[0])
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", x[0], err))
+				inDoubt[x[0]] = true
+				continue
+			}
+			stmt := "XA ROLLBACK "
+			if committed {
+				stmt = "XA COMMIT "
+			}
+			log.Infof("xa recover %s%s", stmt, xid(x[0], x[1]))
+			if _, err = xa.dbs[name].Exec(stmt + xid(x[0], x[1])); err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s: %v", x[0], x[1], err))
+				inDoubt[x[0]] = true
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("mdb: xa recover failed: %s", strings.Join(errs, "; "))
+	}
+	pending, err := xa.decision.Pending()
+	if err != nil {
+		return err
+	}
+	for _, gtrid := range pending {
+		xa.mu.Lock()
+		active := xa.active[gtrid]
+		xa.mu.Unlock()
+		if !active && !inDoubt[gtrid] {
+			if err = xa.decision.Forget(gtrid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// xaRecover 返回 gtrid 以 prefix 开头的 [gtrid, bqual]
+func xaRecover(conn *sql.DB, prefix string) ([][2]string, error) {
+	rows, err := conn.Query("XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids [][2]string
+	for rows.Next() {
+		var formatId, gtridLen, bqualLen int64
+		var data []byte
+		if err = rows.Scan(&formatId, &gtridLen, &bqualLen, &data); err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != gtridLen+bqualLen {
+			continue
+		}
+		gtrid, bqual := string(data[:gtridLen]), string(data[gtridLen:])
+		if strings.HasPrefix(gtrid, prefix) {
+			xids = append(xids, [2]string{gtrid, bqual})
+		}
+	}
+	return xids, rows.Err()
+}
+
+// FileXALog 追加写入的文件，每次写入都 fsync；打开时只保留未 Forget 的记录
+// 第一次创建时随机生成 Node 并保存在文件中，每个实例需要使用自己的文件
+type FileXALog struct {
+	mu      sync.Mutex
+	file    *os.File
+	node    string
+	pending map[string][]string
+}
+
+type xaRecord struct {
+	Xid      string   `json:"xid,omitempty"`
+	State    string   `json:"state"` // node commit 或者 done
+	Node     string   `json:"node,omitempty"`
+	Branches []string `json:"branches,omitempty"`
+}
+
+func OpenFileXALog(path string) (*FileXALog, error) {
+	l := &FileXALog{pending: map[string][]string{}}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r xaRecord
+			// 崩溃时最后一行可能不完整，这样的决定没有生效
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				continue
+			}
+			switch r.State {
+			case "node":
+				l.node = r.Node
+			case "commit":
+				l.pending[r.Xid] = r.Branches
+			default:
+				delete(l.pending, r.Xid)
+			}
+		}
+		_ = f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// 重写为只有未完成的记录，再追加
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	if l.node == "" {
+		node := UUIDv7()
+		l.node = hex.EncodeToString(node[10:])
+	}
+	if err = l.write(xaRecord{State: "node", Node: l.node}); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	for xid, branches := range l.pending {
+		if err = l.write(xaRecord{Xid: xid, State: "commit", Branches: branches}); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		_ = l.file.Close()
+		return nil, err
+	}
+	_ = l.file.Close()
+	l.file = f
+	return l, nil
+}
+
+func (l *FileXALog) write(r xaRecord) error {
+	data, _ := json.Marshal(r)
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *FileXALog) Node() string {
+	return l.node
+}
+
+func (l *FileXALog) Commit(xid string, branches []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.write(xaRecord{Xid: xid, State: "commit", Branches: branches}); err != nil {
+		return err
+	}
+	l.pending[xid] = branches
+	return nil
+}
+
+func (l *FileXALog) Committed(xid string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.pending[xid]
+	return ok, nil
+}
+
+func (l *FileXALog) Forget(xid string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.pending[xid]; !ok {
+		return nil
+	}
+	if err := l.write(xaRecord{Xid: xid, State: "done"}); err != nil {
+		return err
+	}
+	delete(l.pending, xid)
+	return nil
+}
+
+func (l *FileXALog) Pending() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	xids := make([]string, 0, len(l.pending))
+	for xid := range l.pending {
+		xids = append(xids, xid)
+	}
+	sort.Strings(xids)
+	return xids, nil
+}
+
+func (l *FileXALog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,201 @@
+package mdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var gtridPattern = regexp.MustCompile(`mdb-[0-9A-Za-z_]+-[0-9a-f]{32}`)
+
+// assertXAStmts gtrid 替换为 X 后比较，INSERT 等只比较第一个单词
+func assertXAStmts(t *testing.T, l *fakeLog, want ...string) {
+	t.Helper()
+	got := l.all()
+	for i, stmt := range got {
+		if strings.HasPrefix(stmt, "XA ") {
+			got[i] = gtridPattern.ReplaceAllString(stmt, "X")
+		} else {
+			got[i] = strings.Fields(stmt)[0]
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+}
+
+func openXALog(t *testing.T) (*FileXALog, string) {
+	path := filepath.Join(t.TempDir(), "xa.log")
+	l, err := OpenFileXALog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l, path
+}
+
+func insertBoth(sessions map[string]*Session) error {
+	if err := sessions["order"].Model(&Student{ID: NewVarchar("1")}).Insert(); err != nil {
+		return err
+	}
+	return sessions["stock"].Model(&Student{ID: NewVarchar("2")}).Insert()
+}
+
+func TestXACommit(t *testing.T) {
+	orderDb, orderLog := openFakeDb(t)
+	stockDb, stockLog := openFakeDb(t)
+	decision, path := openXALog(t)
+	xa := NewXA(decision, map[string]*sql.DB{"order": orderDb, "stock": stockDb})
+	if err := xa.Run(insertBoth); err != nil {
+		t.Fatal(err)
+	}
+	assertXAStmts(t, orderLog, "XA START 'X','order'", "INSERT", "XA END 'X','order'",
+		"XA PREPARE 'X','order'", "XA COMMIT 'X','order'")
+	assertXAStmts(t, stockLog, "XA START 'X','stock'", "INSERT", "XA END 'X','stock'",
+		"XA PREPARE 'X','stock'", "XA COMMIT 'X','stock'")
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 ||
+		!strings.Contains(lines[0], `"state":"node","node":"`+decision.Node()+`"`) ||
+		!strings.Contains(lines[1], `"state":"commit","branches":["order","stock"]`) ||
+		!strings.Contains(lines[2], `"state":"done"`) {
+		t.Errorf("decision log = %s", data)
+	}
+	if pending, _ := decision.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v", pending)
+	}
+
+	// 只有一个分支时一阶段提交
+	single := NewXA(decision, map[string]*sql.DB{"order": orderDb})
+	orderLog.stmts = nil
+	if err := single.Run(func(sessions map[string]*Session) error {
+		return sessions["order"].Model(&Student{ID: NewVarchar("1")}).Insert()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertXAStmts(t, orderLog, "XA START 'X','order'", "INSERT", "XA END 'X','order'", "XA COMMIT 'X','order' ONE PHASE")
+}
+
+func TestXARollback(t *testing.T) {
+	orderDb, orderLog := openFakeDb(t)
+	stockDb, stockLog := openFakeDb(t)
+	decision, _ := openXALog(t)
+	xa := NewXA(decision, map[string]*sql.DB{"order": orderDb, "stock": stockDb})
+	want := errors.New("out of stock")
+	err := xa.Run(func(sessions map[string]*Session) error {
+		if err := sessions["order"].Model(&Student{ID: NewVarchar("1")}).Insert(); err != nil {
+			return err
+		}
+		// 嵌套的 session 在分支中执行
+		return sessions["stock"].ObtainSession(Write, func(sess *Session) error {
+			_ = sess.Model(&Student{ID: NewVarchar("2")}).Insert()
+			return want
+		})
+	})
+	if err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	assertXAStmts(t, orderLog, "XA START 'X','order'", "INSERT", "XA END 'X','order'", "XA ROLLBACK 'X','order'")
+	assertXAStmts(t, stockLog, "XA START 'X','stock'", "INSERT", "XA END 'X','stock'", "XA ROLLBACK 'X','stock'")
+
+	// prepare 失败时已经 prepared 的分支也回滚
+	orderLog.stmts, stockLog.stmts = nil, nil
+	stockLog.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "XA PREPARE") {
+			return errors.New("prepare failed")
+		}
+		return nil
+	}
+	if err = xa.Run(insertBoth); err == nil {
+		t.Fatal("prepare failure should fail")
+	}
+	assertXAStmts(t, orderLog, "XA START 'X','order'", "INSERT", "XA END 'X','order'",
+		"XA PREPARE 'X','order'", "XA ROLLBACK 'X','order'")
+	assertXAStmts(t, stockLog, "XA START 'X','stock'", "INSERT", "XA END 'X','stock'",
+		"XA PREPARE 'X','stock'", "XA ROLLBACK 'X','stock'")
+	if pending, _ := decision.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v", pending)
+	}
+
+	// panic 时回滚并继续抛出
+	orderLog.stmts, stockLog.stmts, stockLog.fail = nil, nil, nil
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recover = %v, want boom", p)
+		}
+		assertXAStmts(t, orderLog, "XA START 'X','order'", "XA END 'X','order'", "XA ROLLBACK 'X','order'")
+	}()
+	_ = xa.Run(func(sessions map[string]*Session) error {
+		panic("boom")
+	})
+}
+
+func TestXARecover(t *testing.T) {
+	orderDb, orderLog := openFakeDb(t)
+	stockDb, stockLog := openFakeDb(t)
+	decision, path := openXALog(t)
+	xa := NewXA(decision, map[string]*sql.DB{"order": orderDb, "stock": stockDb})
+	// 决定提交之后 stock 的 XA COMMIT 失败
+	stockLog.fail = func(stmt string) error {
+		if strings.HasPrefix(stmt, "XA COMMIT") {
+			return errors.New("connection lost")
+		}
+		return nil
+	}
+	if err := xa.Run(insertBoth); err == nil || !strings.Contains(err.Error(), "stock pending Recover") {
+		t.Fatalf("err = %v, want pending Recover", err)
+	}
+	pending, _ := decision.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("pending = %v, want 1", pending)
+	}
+	committed := pending[0]
+
+	// 重新打开决定的记录，模拟进程重启
+	_ = decision.Close()
+	decision, err := OpenFileXALog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decision.Close()
+	if ok, _ := decision.Committed(committed); !ok {
+		t.Fatalf("%s should be committed after reopen", committed)
+	}
+	if !strings.HasPrefix(committed, "mdb-"+decision.Node()+"-") {
+		t.Fatalf("%s should keep the node %s after reopen", committed, decision.Node())
+	}
+
+	aborted := "mdb-" + decision.Node() + "-0123456789abcdef0123456789abcdef"
+	// 其他实例的分支，可能已经决定提交，不能回滚
+	otherNode := "mdb-othernode-0123456789abcdef0123456789abcdef"
+	recoverRows := func(xids ...[2]string) func(string) ([]string, [][]driver.Value) {
+		return func(stmt string) ([]string, [][]driver.Value) {
+			var values [][]driver.Value
+			for _, x := range xids {
+				values = append(values, []driver.Value{int64(1), int64(len(x[0])), int64(len(x[1])), []byte(x[0] + x[1])})
+			}
+			return []string{"formatID", "gtrid_length", "bqual_length", "data"}, values
+		}
+	}
+	stockLog.fail = nil
+	stockLog.rows = recoverRows([2]string{committed, "stock"}, [2]string{aborted, "stock"},
+		[2]string{otherNode, "stock"}, [2]string{"other-app", "x"})
+	orderLog.rows = recoverRows()
+	orderLog.stmts, stockLog.stmts = nil, nil
+	xa = NewXA(decision, map[string]*sql.DB{"order": orderDb, "stock": stockDb})
+	if err = xa.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	assertXAStmts(t, orderLog, "XA RECOVER")
+	want := []string{"XA RECOVER", "XA COMMIT '" + committed + "','stock'", "XA ROLLBACK '" + aborted + "','stock'"}
+	if got := stockLog.all(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+	if pending, _ = decision.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v after recover", pending)
+	}
+}